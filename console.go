@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Console output modes
+const (
+	outputStream  = "stream"  // print as things happen
+	outputOrdered = "ordered" // print each package's output whole, in go list order
+)
+
+// console serializes what jobs print. In ordered mode it holds each
+// package's output until every package before it is done, and
+// if stdout is a terminal, keeps a status line for each running package
+// below the output.
+type console struct {
+	mu      sync.Mutex
+	out     io.Writer
+	ordered bool
+	live    bool
+
+	order []string
+	next  int
+	held  map[string]string
+	done  map[string]bool
+
+	running map[string]time.Time
+	drawn   int
+	stopped chan blank
+}
+
+func newConsole(mode string, order []string) (*console, error) {
+	c := &console{
+		out:     os.Stdout,
+		order:   order,
+		held:    make(map[string]string),
+		done:    make(map[string]bool),
+		running: make(map[string]time.Time),
+		stopped: make(chan blank),
+	}
+	switch mode {
+	case outputStream:
+	case outputOrdered:
+		c.ordered = true
+		c.live = isTerminal(os.Stdout)
+	default:
+		return nil, fmt.Errorf("unknown output mode %q", mode)
+	}
+	if c.live {
+		go c.tick()
+	}
+	return c, nil
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// started notes that pkg's tests are running.
+func (c *console) started(pkg string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running[pkg] = time.Now()
+	c.redraw()
+}
+
+// finished reports what pkg's tests printed.
+func (c *console) finished(pkg, output string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.running, pkg)
+	if !c.ordered {
+		fmt.Fprint(c.out, output)
+		return
+	}
+	c.held[pkg] = output
+	c.done[pkg] = true
+	c.flush(false)
+}
+
+// printf prints a message about the run as a whole, straight away.
+func (c *console) printf(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clear()
+	fmt.Fprintf(c.out, format, args...)
+	c.draw()
+}
+
+// close prints anything still held back, and stops the status display.
+func (c *console) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.live {
+		close(c.stopped)
+		c.live = false
+	}
+	c.running = make(map[string]time.Time)
+	c.flush(true)
+}
+
+// flush prints the finished packages at the head of the order; with all, it
+// prints the rest too, without waiting for them.
+func (c *console) flush(all bool) {
+	c.clear()
+	for ; c.next < len(c.order); c.next++ {
+		pkg := c.order[c.next]
+		if !all && !c.done[pkg] {
+			break
+		}
+		fmt.Fprint(c.out, c.held[pkg])
+		delete(c.held, pkg)
+	}
+	c.draw()
+}
+
+func (c *console) tick() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			c.redraw()
+			c.mu.Unlock()
+		case <-c.stopped:
+			return
+		}
+	}
+}
+
+func (c *console) redraw() {
+	c.clear()
+	c.draw()
+}
+
+// clear erases the status lines
+func (c *console) clear() {
+	for ; c.drawn > 0; c.drawn-- {
+		fmt.Fprint(c.out, "\x1b[1A\x1b[2K")
+	}
+}
+
+func (c *console) draw() {
+	if !c.live {
+		return
+	}
+	var pkgs []string
+	for pkg := range c.running {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	var lines []string
+	for _, pkg := range pkgs {
+		lines = append(lines, fmt.Sprintf("  running %s (%v)", pkg, time.Since(c.running[pkg]).Truncate(time.Second)))
+	}
+	if len(lines) > 0 {
+		fmt.Fprintln(c.out, strings.Join(lines, "\n"))
+	}
+	c.drawn = len(lines)
+}
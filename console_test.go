@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsoleOrdered(t *testing.T) {
+	c, err := newConsole(outputOrdered, []string{"a", "b", "c"})
+	require.NoError(t, err)
+	var out bytes.Buffer
+	c.out = &out
+	c.live = false
+
+	c.started("b")
+	c.started("a")
+	c.finished("b", "ok b\n")
+	assert.Empty(t, out.String(), "b waits for a")
+
+	c.finished("a", "ok a\n")
+	assert.Equal(t, "ok a\nok b\n", out.String())
+
+	c.started("c")
+	c.close()
+	assert.Equal(t, "ok a\nok b\n", out.String())
+}
+
+func TestConsoleStream(t *testing.T) {
+	c, err := newConsole(outputStream, []string{"a", "b"})
+	require.NoError(t, err)
+	var out bytes.Buffer
+	c.out = &out
+
+	c.started("b")
+	c.finished("b", "ok b\n")
+	assert.Equal(t, "ok b\n", out.String())
+
+	_, err = newConsole("sideways", nil)
+	assert.Error(t, err)
+}
+
+func TestSummarize(t *testing.T) {
+	j := exec.Command("go", "test", "--coverprofile=/tmp/x/a-b.coverprofile", "a/b")
+	verbose := "=== RUN   TestX\n--- PASS: TestX (0.00s)\nPASS\nok  \ta/b\t0.1s\tcoverage: 50.0% of statements\n"
+	assert.Equal(t, "ok  \ta/b\t0.1s\tcoverage: 50.0% of statements\n", summarize(result{j: j, o: []byte(verbose)}))
+	assert.Equal(t, "ok  \ta/b\n", summarize(result{j: j}))
+
+	assert.Equal(t, "/tmp/x/a-b.log", logpath(profileArg(j)))
+	assert.Equal(t, "a/b (log: /tmp/x/a-b.log)", withLog(result{j: j, log: "/tmp/x/a-b.log"}))
+	assert.Equal(t, "a/b", withLog(result{j: j}))
+}
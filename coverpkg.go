@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Strategies for choosing what each test binary instruments, when --coverpkg
+// isn't given.
+const (
+	coverSelector     = "selector"       // the package selector, as given
+	coverSelf         = "self"           // just the package under test
+	coverModule       = "module"         // everything in the module, as <module>/...
+	coverDepsInModule = "deps-in-module" // the package and whatever it imports from the module
+	coverAll          = "all"            // every selected package, listed out
+)
+
+// coverpkgs works out the --coverpkg value for each package to be tested.
+func coverpkgs(strategy, selector string, selected, tested []pkgInfo) (map[string]string, error) {
+	cpkgs := make(map[string]string)
+	set := func(value func(pkgInfo) string) (map[string]string, error) {
+		for _, p := range tested {
+			cpkgs[p.ImportPath] = value(p)
+		}
+		return cpkgs, nil
+	}
+
+	switch strategy {
+	case coverSelector:
+		return set(func(pkgInfo) string { return selector })
+	case coverSelf:
+		return set(func(p pkgInfo) string { return p.ImportPath })
+	case coverModule:
+		root := moduleRoot(selected)
+		if root == "" {
+			return nil, fmt.Errorf("coverpkg strategy %q needs a module", strategy)
+		}
+		return set(func(pkgInfo) string { return root + "/..." })
+	case coverDepsInModule:
+		inModule, err := moduleDeps(selector)
+		if err != nil {
+			return nil, err
+		}
+		return set(func(p pkgInfo) string {
+			return strings.Join(append([]string{p.ImportPath}, inModule[p.ImportPath]...), ",")
+		})
+	case coverAll:
+		all := strings.Join(importPaths(selected), ",")
+		return set(func(pkgInfo) string { return all })
+	}
+	return nil, fmt.Errorf("unknown coverpkg strategy %q", strategy)
+}
+
+// moduleDeps lists, for each package matched by selector, the packages it
+// imports from the main module.
+func moduleDeps(selector string) (map[string][]string, error) {
+	gl := exec.Command("go", "list", "-deps", "-json", selector)
+	var stderr bytes.Buffer
+	gl.Stderr = &stderr
+	list, err := gl.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s%v", stderr.String(), err)
+	}
+	return parseModuleDeps(list)
+}
+
+// parseModuleDeps reads go list -deps -json output into the packages each
+// listed package imports from the main module.
+func parseModuleDeps(list []byte) (map[string][]string, error) {
+	type dep struct {
+		ImportPath string
+		DepOnly    bool
+		Deps       []string
+		Module     *struct {
+			Main bool
+		}
+	}
+	var all []dep
+	inModule := make(map[string]bool)
+	dec := json.NewDecoder(bytes.NewReader(list))
+	for {
+		var d dep
+		err := dec.Decode(&d)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, d)
+		inModule[d.ImportPath] = d.Module != nil && d.Module.Main
+	}
+
+	deps := make(map[string][]string)
+	for _, d := range all {
+		if d.DepOnly {
+			continue
+		}
+		for _, i := range d.Deps {
+			if inModule[i] {
+				deps[d.ImportPath] = append(deps[d.ImportPath], i)
+			}
+		}
+	}
+	return deps, nil
+}
+
+// excludeCoverpkgs takes the packages exclude drops out of each --coverpkg
+// value, so that they aren't instrumented either. Patterns like ./... are
+// left as they are: listing out what they match can make a command line too
+// long to run, and the files of excluded packages they take in are dropped
+// when the profiles are merged.
+func excludeCoverpkgs(cpkgs map[string]string, exclude patternList) {
+	for pkg, value := range cpkgs {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if strings.Contains(item, "...") || !exclude.matches(item) {
+				items = append(items, item)
+			}
+		}
+		// an empty --coverpkg would fall back to the package under test
+		if len(items) == 0 {
+			items = []string{pkg}
+		}
+		cpkgs[pkg] = strings.Join(items, ",")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoverpkgs(t *testing.T) {
+	mod := &struct{ Path, Dir string }{Path: "example.com/app"}
+	a := pkgInfo{ImportPath: "example.com/app/a", Module: mod}
+	b := pkgInfo{ImportPath: "example.com/app/b", Module: mod}
+	selected, tested := []pkgInfo{a, b}, []pkgInfo{a}
+
+	for strategy, want := range map[string]string{
+		coverSelector: "./...",
+		coverSelf:     "example.com/app/a",
+		coverModule:   "example.com/app/...",
+		coverAll:      "example.com/app/a,example.com/app/b",
+	} {
+		cpkgs, err := coverpkgs(strategy, "./...", selected, tested)
+		require.NoError(t, err, strategy)
+		assert.Equal(t, map[string]string{"example.com/app/a": want}, cpkgs, strategy)
+	}
+
+	_, err := coverpkgs("bogus", "./...", selected, tested)
+	assert.Error(t, err)
+
+	_, err = coverpkgs(coverModule, "./...", []pkgInfo{{ImportPath: "a"}}, nil)
+	assert.Error(t, err)
+}
+
+func TestParseModuleDeps(t *testing.T) {
+	list := []byte(`{"ImportPath": "fmt", "DepOnly": true}
+{"ImportPath": "example.com/app/util", "DepOnly": true, "Deps": ["fmt"], "Module": {"Main": true}}
+{"ImportPath": "example.com/lib", "DepOnly": true, "Module": {"Main": false}}
+{"ImportPath": "example.com/app/a", "Deps": ["example.com/app/util", "example.com/lib", "fmt"], "Module": {"Main": true}}
+{"ImportPath": "example.com/app/b", "Deps": ["fmt"], "Module": {"Main": true}}
+`)
+	deps, err := parseModuleDeps(list)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"example.com/app/a": {"example.com/app/util"}}, deps)
+}
+
+func TestExcludeCoverpkgs(t *testing.T) {
+	exclude, err := parsePatterns("gen/**", "example.com/app")
+	require.NoError(t, err)
+
+	cpkgs := map[string]string{
+		"example.com/app/a": "./...",
+		"example.com/app/b": "example.com/app/b,example.com/app/gen/pb,example.com/app/gen",
+		"example.com/app/c": "example.com/app/gen/pb",
+	}
+	excludeCoverpkgs(cpkgs, exclude)
+	assert.Equal(t, map[string]string{
+		"example.com/app/a": "./...",
+		"example.com/app/b": "example.com/app/b",
+		"example.com/app/c": "example.com/app/c",
+	}, cpkgs, "patterns are kept, for their files to be dropped at merge")
+}
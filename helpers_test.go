@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tempDir makes a directory for a test, removed once it's done, and writes
+// files into it.
+func tempDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "engulf")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	writeFiles(t, dir, files)
+	return dir
+}
+
+// writeFiles writes each of files, named relative to dir, making directories
+// as needed.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+// goCoverProfile runs go test over the module in dir, with args, and returns
+// the path of the coverage profile it writes.
+func goCoverProfile(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	profile := filepath.Join(dir, "cover.out")
+	c := exec.Command("go", append([]string{"test", "-covermode=count", "-coverprofile=" + profile}, args...)...)
+	c.Dir = dir
+	out, err := c.CombinedOutput()
+	require.NoError(t, err, "%s", out)
+	return profile
+}
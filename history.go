@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const historyFile = "history.json"
+
+// Orders packages can be scheduled in
+const (
+	orderLongest = "longest" // longest expected duration first
+	orderList    = "list"    // as go list has them
+)
+
+// history keeps track of how long each package's tests take, across runs.
+type history map[string]*pkgHistory
+
+type pkgHistory struct {
+	Duration   time.Duration `json:"duration"`
+	LastFailed bool          `json:"last_failed"`
+}
+
+// loadHistory reads the history at path, starting afresh if there isn't one.
+func loadHistory(path string) history {
+	h := make(history)
+	f, err := os.Open(path)
+	if err != nil {
+		return h
+	}
+	defer f.Close()
+	json.NewDecoder(f).Decode(&h)
+	return h
+}
+
+func (h history) save(path string) error {
+	return writeAtomically(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(h)
+	})
+}
+
+// record notes a run of pkg. Durations are averaged with earlier runs, so one
+// slow run doesn't upend the schedule.
+func (h history) record(pkg string, d time.Duration, failed bool) {
+	ph, ok := h[pkg]
+	if !ok {
+		h[pkg] = &pkgHistory{Duration: d, LastFailed: failed}
+		return
+	}
+	ph.Duration = (ph.Duration + d) / 2
+	ph.LastFailed = failed
+}
+
+// schedule orders pkgs longest expected first, so that a slow package doesn't
+// start last and hold up the whole run. Packages with no history are assumed
+// to be slow. With failedFirst, packages that failed last time go ahead of
+// everything else.
+func (h history) schedule(pkgs []pkgInfo, failedFirst bool) []pkgInfo {
+	sorted := append([]pkgInfo(nil), pkgs...)
+	rank := func(p pkgInfo) (bool, time.Duration) {
+		ph, ok := h[p.ImportPath]
+		if !ok {
+			return false, time.Duration(1<<63 - 1)
+		}
+		return failedFirst && ph.LastFailed, ph.Duration
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		fi, di := rank(sorted[i])
+		fj, dj := rank(sorted[j])
+		if fi != fj {
+			return fi
+		}
+		return di > dj
+	})
+	return sorted
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistorySchedule(t *testing.T) {
+	h := make(history)
+	h.record("fast", time.Second, false)
+	h.record("slow", time.Minute, false)
+	h.record("broken", 2*time.Second, true)
+
+	pkgs := []pkgInfo{{ImportPath: "fast"}, {ImportPath: "broken"}, {ImportPath: "new"}, {ImportPath: "slow"}}
+
+	assert.Equal(t, []string{"new", "slow", "broken", "fast"}, importPaths(h.schedule(pkgs, false)))
+	assert.Equal(t, []string{"broken", "new", "slow", "fast"}, importPaths(h.schedule(pkgs, true)))
+	assert.Equal(t, []string{"fast", "broken", "new", "slow"}, importPaths(pkgs))
+}
+
+func TestHistoryRecordAverages(t *testing.T) {
+	dir := tempDir(t, nil)
+	path := filepath.Join(dir, historyFile)
+
+	h := loadHistory(path)
+	h.record("a", 10*time.Second, true)
+	h.record("a", 20*time.Second, false)
+	require.NoError(t, h.save(path))
+
+	loaded := loadHistory(path)
+	assert.Equal(t, &pkgHistory{Duration: 15 * time.Second, LastFailed: false}, loaded["a"])
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/nyarly/engulf/merge"
+	"golang.org/x/tools/cover"
+)
+
+const (
+	ignoreDirective      = "//engulf:ignore"
+	ignoreStartDirective = "//engulf:ignore-start"
+	ignoreEndDirective   = "//engulf:ignore-end"
+)
+
+type position struct {
+	line, col int
+}
+
+// span is a stretch of source from start up to end
+type span struct {
+	start, end position
+}
+
+func (s span) String() string {
+	if s.start.line == s.end.line {
+		return strconv.Itoa(s.start.line)
+	}
+	return strconv.Itoa(s.start.line) + "-" + strconv.Itoa(s.end.line)
+}
+
+func blockSpan(b cover.ProfileBlock) span {
+	return span{position{b.StartLine, b.StartCol}, position{b.EndLine, b.EndCol}}
+}
+
+func (s span) within(o span) bool {
+	return !merge.Before(s.start.line, s.start.col, o.start.line, o.start.col) &&
+		!merge.Before(o.end.line, o.end.col, s.end.line, s.end.col)
+}
+
+func (s span) holds(p position) bool {
+	return !merge.Before(p.line, p.col, s.start.line, s.start.col) &&
+		merge.Before(p.line, p.col, s.end.line, s.end.col)
+}
+
+// ignoredSpans finds the statements and functions annotated to be ignored in
+// the file at path.
+func ignoredSpans(path string) ([]span, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, content, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	pos := func(p token.Pos) position {
+		ps := fset.Position(p)
+		return position{ps.Line, ps.Column}
+	}
+
+	var marks []int // lines with a bare ignore directive
+	var ranges []span
+	var open *span
+	for _, group := range file.Comments {
+		for _, c := range group.List {
+			switch directive(c.Text) {
+			case ignoreDirective:
+				if ownLine(content, fset.Position(c.Pos()).Offset) {
+					marks = append(marks, pos(c.Pos()).line+1)
+				} else {
+					marks = append(marks, pos(c.Pos()).line)
+				}
+			case ignoreStartDirective:
+				if open == nil {
+					open = &span{start: pos(c.Pos())}
+				}
+			case ignoreEndDirective:
+				if open != nil {
+					open.end = pos(c.End())
+					ranges = append(ranges, *open)
+					open = nil
+				}
+			}
+		}
+	}
+	if open != nil {
+		open.end = pos(file.End())
+		ranges = append(ranges, *open)
+	}
+
+	ignored := func(s span) bool {
+		for _, l := range marks {
+			if s.start.line == l || s.end.line == l {
+				return true
+			}
+		}
+		for _, r := range ranges {
+			if s.within(r) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var spans []span
+	listed := make(map[ast.Node]bool)
+	ast.Inspect(file, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.FuncDecl:
+			s := span{pos(n.Pos()), pos(n.End())}
+			if hasDirective(n.Doc, ignoreDirective) || ignored(s) {
+				spans = append(spans, s)
+				return false
+			}
+		case *ast.BlockStmt:
+			for _, s := range n.List {
+				listed[s] = true
+			}
+		case *ast.CaseClause:
+			for _, s := range n.Body {
+				listed[s] = true
+			}
+		case *ast.CommClause:
+			for _, s := range n.Body {
+				listed[s] = true
+			}
+		case ast.Stmt:
+			s := span{pos(n.Pos()), pos(n.End())}
+			if listed[n] && ignored(s) {
+				spans = append(spans, s)
+				return false
+			}
+		}
+		return true
+	})
+	return spans, nil
+}
+
+// dropIgnored removes the blocks inside ignored spans, and discounts ignored
+// statements from the blocks that hold them.
+func dropIgnored(blocks []cover.ProfileBlock, spans []span) []cover.ProfileBlock {
+	var kept []cover.ProfileBlock
+	for _, b := range blocks {
+		bs := blockSpan(b)
+		drop := false
+		for _, s := range spans {
+			if bs.within(s) {
+				drop = true
+				break
+			}
+			if bs.holds(s.start) {
+				b.NumStmt--
+				drop = b.NumStmt <= 0
+			}
+		}
+		if !drop && linesIgnored(b, spans) {
+			drop = true
+		}
+		if !drop {
+			kept = append(kept, b)
+		}
+	}
+	return kept
+}
+
+// linesIgnored reports whether every line of b is in an ignored span. Blocks
+// only hold lines with code on them, and one that ends at the start of a line
+// stops on the line before.
+func linesIgnored(b cover.ProfileBlock, spans []span) bool {
+	last := b.EndLine
+	if b.EndCol == 1 && last > b.StartLine {
+		last--
+	}
+	for line := b.StartLine; line <= last; line++ {
+		ignored := false
+		for _, s := range spans {
+			if s.start.line <= line && line <= s.end.line {
+				ignored = true
+				break
+			}
+		}
+		if !ignored {
+			return false
+		}
+	}
+	return true
+}
+
+// applyIgnores drops annotated code from the merged profiles, and returns a
+// description of each ignored span.
+func applyIgnores(m *merge.Merger, dirs sourceDirs) []string {
+	spans := make(map[string][]span)
+	var report []string
+	for _, mode := range m.Modes() {
+		for _, prof := range m.Profiles(mode) {
+			name := prof.FileName
+			ss, seen := spans[name]
+			if !seen {
+				if path, ok := dirs.path(name); ok {
+					ss, _ = ignoredSpans(path)
+				}
+				spans[name] = ss
+				for _, s := range ss {
+					report = append(report, name+":"+s.String())
+				}
+			}
+			if len(ss) > 0 {
+				prof.Blocks = dropIgnored(prof.Blocks, ss)
+			}
+		}
+	}
+	return report
+}
+
+func directive(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+func hasDirective(doc *ast.CommentGroup, d string) bool {
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if directive(c.Text) == d {
+			return true
+		}
+	}
+	return false
+}
+
+// ownLine reports whether only whitespace precedes offset on its line
+func ownLine(content []byte, offset int) bool {
+	for i := offset - 1; i >= 0 && content[i] != '\n'; i-- {
+		if content[i] != ' ' && content[i] != '\t' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const ignoreSrc = `package sample
+
+func A(a int) int {
+	if a < 0 {
+		panic("impossible") //engulf:ignore
+	}
+	//engulf:ignore
+	if a > 100 {
+		return 100
+	}
+	return a
+}
+
+//engulf:ignore
+func B() {
+	println("debug")
+}
+
+func C() {
+	println("c")
+	//engulf:ignore-start
+	println("d")
+	println("e")
+	//engulf:ignore-end
+}
+`
+
+func TestIgnoredSpans(t *testing.T) {
+	path := filepath.Join(tempDir(t, map[string]string{"s.go": ignoreSrc}), "s.go")
+
+	spans, err := ignoredSpans(path)
+	require.NoError(t, err)
+	var lines []string
+	for _, s := range spans {
+		lines = append(lines, s.String())
+	}
+	assert.Equal(t, []string{"5", "8-10", "15-17", "22", "23"}, lines)
+
+	blocks, err := sourceBlocks(path)
+	require.NoError(t, err)
+	kept := dropIgnored(blocks, spans)
+
+	assert.ElementsMatch(t, lb(
+		bk(4, 2, 4, 11, 1, 0),
+		bk(11, 2, 11, 10, 1, 0),
+		bk(20, 2, 21, 1, 3, 0),
+	), kept)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Each package's files are kept under pkgsDir in the cover directory, in
+// directories following its import path, so that no two packages share a
+// name, and none clash with engulf's own files.
+const pkgsDir = "pkgs"
+
+func profilepath(dir, pkg string) string {
+	return filepath.Join(dir, pkgsDir, filepath.FromSlash(escapePath(pkg))) + ".coverprofile"
+}
+
+// logpath is where the output of the tests that wrote profile is kept.
+func logpath(profile string) string {
+	return strings.TrimSuffix(profile, filepath.Ext(profile)) + ".log"
+}
+
+// escapePath makes an import path safe to use as a file path on case
+// insensitive file systems, the way the module cache does: an upper case
+// letter becomes ! and the lower case letter.
+func escapePath(pkg string) string {
+	var b strings.Builder
+	for _, r := range pkg {
+		if unicode.IsUpper(r) {
+			b.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// defaultCoverdir is a cover directory for the project pkgs belong to, under
+// the system temp dir: named for the project, and told apart from others of
+// the same name by a hash of where it is.
+func defaultCoverdir(pkgs []pkgInfo) string {
+	root := ""
+	for _, p := range pkgs {
+		if p.Module != nil && p.Module.Dir != "" {
+			root = p.Module.Dir
+			break
+		}
+	}
+	if root == "" {
+		root, _ = os.Getwd()
+	}
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	sum := sha1.Sum([]byte(root))
+	return filepath.Join(os.TempDir(), "engulf", fmt.Sprintf("%s-%x", filepath.Base(root), sum[:4]))
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfilepath(t *testing.T) {
+	assert.NotEqual(t, profilepath("/c", "a/b-c"), profilepath("/c", "a-b/c"))
+	assert.NotEqual(t, profilepath("/c", "example.com/Foo"), profilepath("/c", "example.com/foo"))
+	assert.Equal(t, filepath.FromSlash("/c/pkgs/github.com/!sirupsen/logrus.coverprofile"), profilepath("/c", "github.com/Sirupsen/logrus"))
+	assert.Equal(t, filepath.FromSlash("/c/pkgs/a/b.log"), logpath(profilepath("/c", "a/b")))
+}
+
+func TestDefaultCoverdir(t *testing.T) {
+	mod := func(dir string) []pkgInfo {
+		return []pkgInfo{{ImportPath: "example.com/app", Module: &struct{ Path, Dir string }{"example.com/app", dir}}}
+	}
+	a := defaultCoverdir(mod("/src/one/app"))
+	assert.Equal(t, filepath.Join(os.TempDir(), "engulf"), filepath.Dir(a))
+	assert.Contains(t, filepath.Base(a), "app-")
+	assert.Equal(t, a, defaultCoverdir(mod("/src/one/app")))
+	assert.NotEqual(t, a, defaultCoverdir(mod("/src/two/app")))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	lockFile = ".lock"
+	// coverdirAuto asks for a new cover directory for just this run
+	coverdirAuto = "auto"
+)
+
+var lockPoll = 100 * time.Millisecond
+
+// errLocked means another run holds the lock.
+var errLocked = errors.New("locked")
+
+// lockCoverdir takes an advisory lock on dir, so that two runs don't write
+// over each other's profiles. If another run has it, lockCoverdir waits up to
+// wait for it to finish. The lock lasts as long as the returned file is open.
+func lockCoverdir(dir string, wait time.Duration) (*os.File, error) {
+	if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, lockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	waiting := false
+	for {
+		err := tryLock(f)
+		if err == nil {
+			break
+		}
+		if err != errLocked {
+			f.Close()
+			return nil, err
+		}
+		holder := lockHolder(path)
+		if !time.Now().Before(deadline) {
+			f.Close()
+			if wait > 0 {
+				return nil, fmt.Errorf("gave up after %v waiting for another engulf run (%s) to finish with %s", wait, holder, dir)
+			}
+			return nil, fmt.Errorf("another engulf run (%s) is using %s: wait for it to finish, or use --lock-wait, or a different --coverdir", holder, dir)
+		}
+		if !waiting {
+			fmt.Printf("Waiting for another engulf run (%s) to finish with %s\n", holder, dir)
+			waiting = true
+		}
+		time.Sleep(lockPoll)
+	}
+	// leave a note for anyone waiting on us
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return f, nil
+}
+
+func lockHolder(path string) string {
+	pid, err := ioutil.ReadFile(path)
+	if err != nil || len(strings.TrimSpace(string(pid))) == 0 {
+		return "pid unknown"
+	}
+	return "pid " + strings.TrimSpace(string(pid))
+}
+
+// autoCoverdir makes a fresh cover directory under the system temp dir.
+func autoCoverdir() (string, error) {
+	return ioutil.TempDir("", "engulf-")
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockCoverdir(t *testing.T) {
+	dir := tempDir(t, nil)
+
+	held, err := lockCoverdir(dir, 0)
+	require.NoError(t, err)
+
+	_, err = lockCoverdir(dir, 0)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "another engulf run")
+
+	_, err = lockCoverdir(dir, 3*lockPoll)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "gave up")
+
+	time.AfterFunc(2*lockPoll, func() { held.Close() })
+	again, err := lockCoverdir(dir, time.Minute)
+	require.NoError(t, err)
+	again.Close()
+}
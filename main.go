@@ -1,61 +1,194 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/nyarly/engulf/merge"
 	"golang.org/x/tools/cover"
 )
 
 type (
 	blank  struct{}
 	result struct {
-		j *exec.Cmd
-		o []byte
-		e error
+		j     *exec.Cmd
+		o     []byte
+		e     error
+		d     time.Duration
+		flaky *flakyTests
+		log   string
+		// the package's source as it was when the job was dispatched
+		sources jobSources
 	}
 )
 
+const (
+	partialSuffix = ".partial"
+	flakyFile     = "flaky.json"
+	// how long cancelled tests get to stop before they're killed
+	killGrace = 10 * time.Second
+)
+
 var (
+	errCancelled  = errors.New("cancelled")
+	errNotRun     = errors.New("not run")
+	errOverMemory = errors.New("over memory limit")
+
 	nothing   = blank{}
 	pkgWarnRE = regexp.MustCompile(`(?m)^warning: no packages being tested depend on \S+$\n`)
-	pathSep   = regexp.MustCompile(`/`)
+	summaryRE = regexp.MustCompile(`(?m)^(?:ok|FAIL|\?)\s.*$`)
+
+	// the test processes running now, so a second interrupt can kill them
+	running = newProcSet()
 )
 
 func main() {
 	opts := parseOpts()
+	rewrites, err := loadRewrites(opts.rewrite)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if opts.verify {
+		if verify(opts.profile, rewrites) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
-	gl := exec.Command("go", "list", opts.packageSelector)
-	list, err := gl.CombinedOutput()
+	out := mergeOutput{
+		dir:    opts.coverdir,
+		base:   opts.mergeBase,
+		path:   opts.output,
+		mixed:  opts.mixedModes,
+		stdout: os.Stdout,
+	}
+	merging := out.base != "" || out.path != ""
+	if out.path == stdoutPath {
+		// the profile has stdout to itself; everything else goes to stderr
+		os.Stdout = os.Stderr
+	}
+
+	infos, err := listPackages(opts.packageSelector)
 	if err != nil {
-		fmt.Print(string(list))
+		fmt.Print(err)
 		os.Exit(1)
 	}
-	pkgs := strings.Split(string(list), "\n")
-	pkgs = pkgs[:len(pkgs)-1]
 
-	excludeRE := regexp.MustCompile(strings.Join(strings.Split(opts.exclude, ","), "|"))
-	excludeFilesRE := regexp.MustCompile(strings.Join(strings.Split(opts.excludeFiles, ","), "|"))
-	for i := 0; i < len(pkgs); {
-		if excludeRE.MatchString(pkgs[i]) {
-			pkgs[i] = pkgs[len(pkgs)-1]
-			pkgs = pkgs[:len(pkgs)-1]
+	root := moduleRoot(infos)
+	switch opts.coverdir {
+	case "":
+		opts.coverdir = defaultCoverdir(infos)
+	case coverdirAuto:
+		opts.coverdir, err = autoCoverdir()
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Cover dir for this run: %s\n", opts.coverdir)
+	}
+	out.dir = opts.coverdir
+	lock, err := lockCoverdir(opts.coverdir, opts.lockWait)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// held until engulf exits
+	defer lock.Close()
+	exclude, err := parsePatterns(opts.exclude, root)
+	if err != nil {
+		fmt.Print(err)
+		os.Exit(1)
+	}
+	excludeFiles, err := parsePatterns(opts.excludeFiles, root)
+	if err != nil {
+		fmt.Print(err)
+		os.Exit(1)
+	}
+	// packages left out of the run stay out of the merged profile too, even
+	// when a --coverpkg pattern has other test binaries instrument them
+	excludeFiles = exclude.packageFiles().concat(excludeFiles)
+	for i := 0; i < len(infos); {
+		if exclude.matches(infos[i].ImportPath) {
+			infos[i] = infos[len(infos)-1]
+			infos = infos[:len(infos)-1]
 		} else {
 			i++
 		}
 	}
+	pkgs := importPaths(infos)
 
-	fmt.Printf("Excluding packages: '%v' files: '%v'\n", excludeRE, excludeFilesRE)
+	var tested, untested []pkgInfo
+	for _, p := range infos {
+		if p.hasTests() {
+			tested = append(tested, p)
+		} else {
+			untested = append(untested, p)
+		}
+	}
+
+	fmt.Printf("Excluding packages: '%v' files: '%v'\n", exclude, excludeFiles)
 	fmt.Printf("Running with: \n\t%s\n", strings.Join(pkgs, "\n\t"))
 
+	var added []string
+	for _, p := range strings.Split(opts.addProfiles, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			added = append(added, p)
+		}
+	}
+
+	completed := importPaths(tested)
+	var runErr error
+	hashes := newSourceHashes(newSourceDirs(infos))
+	manifest, manifestErr := loadManifest(opts.coverdir)
+	// mergeFresh merges pkgs' profiles, less any made from source that has
+	// since changed
+	mergeFresh := func(out mergeOutput, pkgs []string) error {
+		if manifest != nil {
+			var err error
+			// hashed afresh, as the source may have changed during the run
+			current := newSourceHashes(newSourceDirs(infos))
+			if pkgs, err = freshPackages(manifest, pkgs, current, opts.stale); err != nil {
+				return err
+			}
+		}
+		return mergedProfiles(opts.coverdir, out, opts.covermode, pkgs, added, infos, excludeFiles, !opts.includeGenerated, opts.mergeConflicts, rewrites)
+	}
 	if !opts.onlyMerge {
-		if opts.coverpkg == "" {
-			opts.coverpkg = strings.Join(pkgs, ",")
+		completed = nil
+		if err := manifestErr; err != nil {
+			if opts.rerunFailed || opts.resume {
+				fmt.Printf("Can't pick up from the last run: %v\n", err)
+				os.Exit(1)
+			}
+			manifest = newManifest()
+		}
+
+		cpkgs, err := coverpkgs(opts.coverStrategy, opts.packageSelector, infos, tested)
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+		if opts.coverpkg != "" {
+			for p := range cpkgs {
+				cpkgs[p] = opts.coverpkg
+			}
+		} else {
+			excludeCoverpkgs(cpkgs, exclude)
 		}
 
 		var covArgs []string
@@ -69,123 +202,431 @@ func main() {
 		if opts.parallel {
 			covArgs = append(covArgs, "-parallel")
 		}
+		if opts.retries > 0 {
+			covArgs = append(covArgs, "-json")
+		}
+		if opts.jobMemory > 0 && opts.jobMemory < minJobMemory {
+			fmt.Printf("Warning: --job-memory limits address space, and under %dMiB there may not be enough for test binaries to start\n", minJobMemory>>20)
+		}
+		limitArgs, err := memoryLimitArgs(opts.coverdir, opts.jobMemory)
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+		covArgs = append(covArgs, limitArgs...)
+
+		revision := sourceRevision("")
+		flags := make(map[string]string)
+		for _, p := range tested {
+			flags[p.ImportPath] = jobFlags(cpkgs[p.ImportPath], opts.covermode, covArgs)
+		}
+		record := func(pkg, outcome string, sources jobSources) {
+			profile := profilepath(opts.coverdir, pkg)
+			var files map[string]string
+			if outcome == outcomePassed || outcome == outcomeFailed {
+				files = hashes.profileHashes(profile, sources)
+			}
+			manifest.record(pkg, &pkgRecord{
+				Outcome:  outcome,
+				Profile:  profile,
+				Log:      logpath(profile),
+				Flags:    flags[pkg],
+				Revision: revision,
+				Files:    files,
+			})
+		}
 
-		covJobs := make(chan *exec.Cmd, opts.maxJobs)
-		startC := make(chan blank, opts.maxJobs)
-		stopC := make(chan result, opts.maxJobs)
+		toRun := tested
+		// packages that failed in the run being resumed, which still fail this one
+		var failedBefore []string
+		switch {
+		case opts.rerunFailed:
+			toRun = nil
+			for _, p := range tested {
+				if manifest.passed(p.ImportPath) {
+					completed = append(completed, p.ImportPath)
+				} else {
+					toRun = append(toRun, p)
+				}
+			}
+			fmt.Printf("Rerunning packages that didn't pass last time: \n\t%s\n", strings.Join(importPaths(toRun), "\n\t"))
+		case opts.resume:
+			if revision == "" {
+				fmt.Println("Can't resume: without a git checkout, there's no telling whether the source has changed since the last run")
+				os.Exit(1)
+			}
+			var done []string
+			toRun, done, failedBefore = manifest.resume(tested, flags, revision)
+			completed = append(completed, done...)
+			fmt.Printf("Resuming, %d packages already done. Still to run: \n\t%s\n", len(completed), strings.Join(importPaths(toRun), "\n\t"))
+		}
+
+		maxJobs, err := parseJobs(opts.maxJobs, opts.jobMemory)
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+		covJobs := make(chan *exec.Cmd, maxJobs)
 
-		go queueJobs(covJobs, opts.coverdir, opts.coverpkg, opts.covermode, covArgs, pkgs)
+		// ordered output follows go list order, whatever order packages run in
+		order := importPaths(toRun)
+		con, err := newConsole(opts.console, order)
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
 
-		for j := range covJobs {
-			go runJob(j, startC, stopC)
+		if len(untested) > 0 {
+			fmt.Printf("No test files, counting as uncovered: \n\t%s\n", strings.Join(importPaths(untested), "\n\t"))
 		}
 
-		var result error
-		for i := 0; i < len(pkgs); i++ {
-			res := <-stopC
-			<-startC
-			if res.e != nil {
-				fmt.Print(formatTests(res))
-			} else {
-				fmt.Print(string(stripWarns(res.o)))
+		// dispatch stops dispatching new packages; cancel also kills running ones
+		dispatch, cancel := newStopper(), newStopper()
+		halt := func(why string) {
+			dispatch.stop(why)
+			cancel.stop(why)
+		}
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			con.printf("Interrupted: cancelling tests (interrupt again to kill them and exit)\n")
+			halt("interrupted")
+			<-sigs
+			con.printf("Interrupted again: killing tests\n")
+			running.killAll()
+			os.Exit(1)
+		}()
+		if opts.timeBudget > 0 {
+			time.AfterFunc(opts.timeBudget, func() {
+				con.printf("Time budget of %v used up: not starting any more packages\n", opts.timeBudget)
+				dispatch.stop("time budget of " + opts.timeBudget.String() + " used up")
+			})
+		}
+
+		historyPath := opts.history
+		if historyPath == "" {
+			historyPath = filepath.Join(opts.coverdir, historyFile)
+		}
+		hist := loadHistory(historyPath)
+		switch opts.order {
+		case orderLongest:
+			toRun = hist.schedule(toRun, opts.failedFirst)
+		case orderList:
+		default:
+			fmt.Printf("Unknown order %q\n", opts.order)
+			os.Exit(1)
+		}
+
+		for _, p := range toRun {
+			record(p.ImportPath, outcomeNotRun, jobSources{})
+		}
+		if err := manifest.save(opts.coverdir); err != nil {
+			log.Print(err)
+		}
+
+		go queueJobs(covJobs, dispatch.c, opts.coverdir, cpkgs, opts.covermode, covArgs, importPaths(toRun))
+
+		byPath := make(map[string]pkgInfo)
+		for _, p := range toRun {
+			byPath[p.ImportPath] = p
+		}
+		stopC := startWorkers(maxJobs, covJobs, func(j *exec.Cmd) result {
+			// hashed before go test builds anything, so that an edit made
+			// while the tests run makes the profile stale
+			sources := hashes.dispatched(byPath[j.Args[len(j.Args)-1]])
+			res := runJob(j, dispatch.c, cancel.c, opts.retries, opts.jobMemory, con)
+			res.sources = sources
+			return res
+		})
+
+		var failed, overMemory []string
+		var passed, cancelled int
+		var flaky []*flakyTests
+		for res := range stopC {
+			if res.flaky != nil {
+				flaky = append(flaky, res.flaky)
+			}
+			switch {
+			case res.e == errNotRun:
+				con.finished(res.pkg(), "")
+			case res.e == errOverMemory:
+				con.finished(res.pkg(), formatTests(res))
+				overMemory = append(overMemory, withLog(res))
+				record(res.pkg(), outcomeOverMemory, res.sources)
+			case res.e == errCancelled:
+				con.finished(res.pkg(), "")
+				cancelled++
+				record(res.pkg(), outcomeCancelled, res.sources)
+			case res.e != nil:
+				con.finished(res.pkg(), formatTests(res))
+				completed = append(completed, res.pkg())
+				failed = append(failed, withLog(res))
+				record(res.pkg(), outcomeFailed, res.sources)
+				hist.record(res.pkg(), res.d, true)
+				if opts.failFast {
+					halt("fail-fast after " + res.pkg() + " failed")
+				}
+			default:
+				con.finished(res.pkg(), summarize(res))
+				completed = append(completed, res.pkg())
+				passed++
+				record(res.pkg(), outcomePassed, res.sources)
+				hist.record(res.pkg(), res.d, false)
 			}
+			// saved as we go, so that a killed run can be resumed
+			if err := manifest.save(opts.coverdir); err != nil {
+				log.Print(err)
+			}
+		}
+
+		con.close()
+
+		if err := hist.save(historyPath); err != nil {
+			log.Print(err)
+		}
+
+		finished := passed + len(failed) + len(overMemory)
+		failed = append(failedBefore, failed...)
+		fmt.Printf("\n%d passed, %d failed, %d over memory limit, %d cancelled, %d not run\n",
+			passed, len(failed), len(overMemory), cancelled, len(toRun)-finished-cancelled)
+		if len(flaky) > 0 {
+			fmt.Println("Flaky tests (passed on retry):")
+			for _, f := range flaky {
+				fmt.Printf("\t%s: %s (%d attempts)\n", f.Package, strings.Join(f.Tests, ", "), f.Attempts)
+			}
+		}
+		if opts.retries > 0 {
+			if err := writeFlaky(filepath.Join(opts.coverdir, flakyFile), flaky); err != nil {
+				log.Print(err)
+			}
+		}
+		if len(overMemory) > 0 {
+			fmt.Printf("Over the %dMiB memory limit: \n\t%s\n", opts.jobMemory>>20, strings.Join(overMemory, "\n\t"))
+		}
+		if len(failed) > 0 {
+			fmt.Printf("Failed: \n\t%s\n", strings.Join(failed, "\n\t"))
+		}
+		if len(failed)+len(overMemory) > 0 {
+			runErr = fmt.Errorf("%d packages failed\n", len(failed)+len(overMemory))
 		}
 
-		if result != nil {
-			fmt.Print(result)
+		if stoppedEarly(dispatch, len(toRun), finished) {
+			fmt.Printf("Stopped early: %s\n", dispatch.why)
+			if !opts.mergePartial || !merging {
+				os.Exit(1)
+			}
+			fmt.Printf("Merging partial results from: \n\t%s\n", strings.Join(completed, "\n\t"))
+			if err := mergeFresh(out.partial(), completed); err != nil {
+				fmt.Printf("Couldn't merge profiles: %v\n", err)
+			}
+			fmt.Printf("Merged profiles are partial: %d of %d packages ran\n", len(completed), len(tested))
 			os.Exit(1)
 		}
 	}
 
-	if opts.mergeBase != "" {
-		mergedProfiles(opts.coverdir, opts.mergeBase, pkgs, excludeFilesRE)
+	if merging {
+		if err := mergeFresh(out, completed); err != nil {
+			fmt.Printf("Couldn't merge profiles: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if runErr != nil {
+		fmt.Print(runErr)
+		os.Exit(1)
 	}
 }
 
-func mergedProfiles(dir, basename string, pkgs []string, excludeFilesRE *regexp.Regexp) {
-	merged := make(map[string]map[string]*cover.Profile)
+// stopper broadcasts a stop, once, by closing its channel.
+type stopper struct {
+	c    chan blank
+	once sync.Once
+	why  string
+}
+
+func newStopper() *stopper {
+	return &stopper{c: make(chan blank)}
+}
+
+func (s *stopper) stop(why string) {
+	s.once.Do(func() {
+		s.why = why
+		close(s.c)
+	})
+}
+
+func (s *stopper) stopped() bool {
+	return isClosed(s.c)
+}
+
+// stoppedEarly reports whether dispatch was stopped before all toRun
+// packages had finished. A stop after the last package started, which a
+// --time-budget can bring, doesn't count.
+func stoppedEarly(dispatch *stopper, toRun, finished int) bool {
+	return dispatch.stopped() && finished < toRun
+}
+
+// mergedProfiles merges the profiles of pkgs from dir, along with the added
+// profiles, made elsewhere, and writes them to out.
+func mergedProfiles(dir string, out mergeOutput, mode string, pkgs, added []string, sources []pkgInfo, excludeFiles patternList, skipGenerated bool, conflicts string, rewrites rewriteRules) error {
+	m, err := merge.NewMerger(conflicts)
+	if err != nil {
+		return err
+	}
 
 	for _, pkg := range pkgs {
-		profs, err := cover.ParseProfiles(profilepath(dir, pkg))
+		path := profilepath(dir, pkg)
+		profs, err := cover.ParseProfiles(path)
 		if err != nil {
 			log.Print(err)
 			continue
 		}
 
-		for _, prof := range profs {
-			moded, ok := merged[prof.Mode]
-			if !ok {
-				moded = make(map[string]*cover.Profile)
-				merged[prof.Mode] = moded
-			}
-			filed, ok := moded[prof.FileName]
-			if !ok {
-				filed = &cover.Profile{
-					FileName: prof.FileName,
-					Mode:     prof.Mode,
-					Blocks:   prof.Blocks,
-				}
-				moded[prof.FileName] = filed
-			} else {
-				big := len(prof.Blocks)
-				sml := len(filed.Blocks)
-				newList := mergeBlocks(filed.Blocks, prof.Blocks)
-				if big < sml {
-					big, sml = sml, big
-				}
-				// XXX This is too low on purpose
-				if len(newList) > big+3*sml {
-					log.Println("Existing:")
-					for _, b := range filed.Blocks {
-						log.Println(b)
-					}
-					log.Println("Incoming:")
-					for _, b := range prof.Blocks {
-						log.Println(b)
-					}
-					log.Println("Result:")
-					for _, b := range newList {
-						log.Println(b)
-					}
-					log.Panicf("Resulting blocklist is way too big: %d > %d (=%d + 3* %d)", len(newList), big+sml*3, big, sml)
-				}
-				filed.Blocks = newList
+		rewrites.profiles(profs)
+		if err := m.Add(path, profs); err != nil {
+			return err
+		}
+	}
+	for _, path := range added {
+		// asked for by name, so unlike a package's profile, it has to be there
+		profs, err := cover.ParseProfiles(path)
+		if err != nil {
+			return err
+		}
+		rewrites.profiles(profs)
+		if err := m.Add(path, profs); err != nil {
+			return err
+		}
+	}
+	if out.mixed == mixedConvert {
+		from, to, err := m.Unify()
+		if err != nil {
+			return err
+		}
+		if to != "" {
+			fmt.Printf("Warning: profiles were made in different cover modes (%s): merging them all as %s\n", strings.Join(from, ", "), to)
+			if to == merge.ModeSet {
+				fmt.Println("Warning: merged coverage only says whether blocks ran, not how often")
 			}
 		}
 	}
 
-	for kind, m := range merged {
-		var list []*cover.Profile
-		for _, prf := range m {
-			list = append(list, prf)
+	if len(m.Conflicts()) > 0 {
+		var files []string
+		for _, c := range m.Conflicts() {
+			files = append(files, c.String())
+		}
+		how := "kept the first blocks, with the highest count for each line"
+		if conflicts == merge.Drop {
+			how = "left the files out"
 		}
+		fmt.Fprintf(os.Stderr, "Warning: conflicting coverage, %s:\n\t%s\n", how, strings.Join(files, "\n\t"))
+	}
 
-		fname := filepath.Join(dir, kind+basename)
-		writeCoverprofile(fname, kind, list, excludeFilesRE)
+	modes := m.Modes()
+	if len(modes) == 0 {
+		modes = []string{mode}
+	}
+	var synthesized []string
+	for _, pkg := range sources {
+		for _, name := range addZeroProfiles(m, modes, pkg) {
+			if !excludeFiles.matches(name) {
+				synthesized = append(synthesized, name)
+			}
+		}
+	}
+	if len(synthesized) > 0 {
+		fmt.Printf("No coverage recorded, counting as uncovered: \n\t%s\n", strings.Join(synthesized, "\n\t"))
 	}
-}
 
-func writeCoverprofile(filename, mode string, list []*cover.Profile, excludeFilesRE *regexp.Regexp) error {
-	pf, err := os.Create(filename)
+	dirs := newSourceDirs(sources)
+	if ignored := applyIgnores(m, dirs); len(ignored) > 0 {
+		fmt.Printf("Ignoring annotated code: \n\t%s\n", strings.Join(ignored, "\n\t"))
+	}
+
+	generated := make(map[string]bool)
+	if skipGenerated {
+		generated = generatedFiles(m, dirs, excludeFiles)
+	}
+
+	files, err := out.files(modes)
 	if err != nil {
 		return err
 	}
-	defer pf.Close()
+	for _, kind := range modes {
+		if err := out.write(files[kind], kind, m.Profiles(kind), excludeFiles, generated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generatedFiles finds the generated source files among the merged profiles,
+// and reports them as excluded.
+func generatedFiles(m *merge.Merger, dirs sourceDirs, excludeFiles patternList) map[string]bool {
+	generated := make(map[string]bool)
+	var names []string
+	for _, mode := range m.Modes() {
+		for _, prof := range m.Profiles(mode) {
+			name := prof.FileName
+			if _, seen := generated[name]; seen || excludeFiles.matches(name) {
+				continue
+			}
+			path, ok := dirs.path(name)
+			generated[name] = ok && isGenerated(path)
+			if generated[name] {
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		fmt.Printf("Excluding generated files: \n\t%s\n", strings.Join(names, "\n\t"))
+	}
+	return generated
+}
 
-	fmt.Fprintf(pf, "mode: %s\n", mode)
+// writeCoverprofile writes list to filename, sorted by file name and then
+// position, so that the same coverage always makes the same file. It's
+// written to a temporary file first, and renamed into place, so filename is
+// never left half written.
+func writeCoverprofile(filename, mode string, list []*cover.Profile, excludeFiles patternList, generated map[string]bool) error {
+	return writeAtomically(filename, func(w io.Writer) error {
+		return formatCoverprofile(w, mode, list, excludeFiles, generated)
+	})
+}
 
+func formatCoverprofile(w io.Writer, mode string, list []*cover.Profile, excludeFiles patternList, generated map[string]bool) error {
+	var kept []*cover.Profile
 	for _, p := range list {
-		for _, b := range p.Blocks {
-			if !excludeFilesRE.MatchString(p.FileName) {
-				fmt.Fprintf(pf, "%s:%d.%d,%d.%d %d %d\n",
-					p.FileName,
-					b.StartLine, b.StartCol, b.EndLine, b.EndCol,
-					b.NumStmt, b.Count,
-				)
-			}
+		if !excludeFiles.matches(p.FileName) && !generated[p.FileName] {
+			kept = append(kept, p)
 		}
 	}
-	return nil
+	return merge.WriteProfiles(w, mode, kept)
+}
+
+// writeAtomically writes filename with write, by way of a temporary file in
+// the same directory that's renamed over it once it's complete.
+func writeAtomically(filename string, write func(io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
 }
 
 func stripWarns(out []byte) []byte {
@@ -193,19 +634,50 @@ func stripWarns(out []byte) []byte {
 }
 
 func formatTests(res result) string {
-	return "BEGIN  " + res.j.Args[len(res.j.Args)-1] + "\n" + string(stripWarns(res.o))
+	return "BEGIN  " + res.pkg() + "\n" + string(stripWarns(res.o))
 }
 
-func queueJobs(covJobs chan *exec.Cmd, dir, cpkg, mode string, covArgs, pkgs []string) {
+// summarize picks go test's one line verdicts out of a passing package's
+// output; the rest is in its log. A flaky package gets just the verdict of
+// the attempt that passed, marked as flaky.
+func summarize(res result) string {
+	lines := summaryRE.FindAll(res.o, -1)
+	if len(lines) == 0 {
+		lines = [][]byte{[]byte("ok  \t" + res.pkg())}
+	}
+	if res.flaky != nil {
+		return fmt.Sprintf("%s\t(flaky: passed on attempt %d)\n", lines[len(lines)-1], res.flaky.Attempts)
+	}
+	return string(bytes.Join(lines, []byte("\n"))) + "\n"
+}
+
+// withLog names a package along with where its log is, if it has one.
+func withLog(res result) string {
+	if res.log == "" {
+		return res.pkg()
+	}
+	return res.pkg() + " (log: " + res.log + ")"
+}
+
+// jobFlags describes the go test flags that shape a package's profile
+func jobFlags(cpkg, mode string, covArgs []string) string {
+	return strings.Join(append([]string{"--coverpkg=" + cpkg, "--covermode=" + mode}, covArgs...), " ")
+}
+
+func queueJobs(covJobs chan *exec.Cmd, cancel chan blank, dir string, cpkgs map[string]string, mode string, covArgs, pkgs []string) {
+	defer close(covJobs)
 	for _, p := range pkgs {
 		path := profilepath(dir, p)
 		os.MkdirAll(filepath.Dir(path), os.ModeDir|os.ModePerm)
-		cov := exec.Command("go", "test", "--coverprofile="+path, "--coverpkg="+cpkg, "--covermode="+mode)
+		cov := exec.Command("go", "test", "--coverprofile="+path, "--coverpkg="+cpkgs[p], "--covermode="+mode)
 		cov.Args = append(cov.Args, covArgs...)
 		cov.Args = append(cov.Args, p)
-		covJobs <- cov
+		select {
+		case covJobs <- cov:
+		case <-cancel:
+			return
+		}
 	}
-	close(covJobs)
 }
 
 func escaped(arg string) string {
@@ -215,31 +687,189 @@ func escaped(arg string) string {
 	return arg
 }
 
-func logCmd(c *exec.Cmd) {
+func logCmd(w io.Writer, c *exec.Cmd) {
 	args := []string{}
 	for _, a := range c.Args {
 		args = append(args, escaped(a))
 	}
-	fmt.Printf("%s\n", strings.Join(args, " "))
+	fmt.Fprintf(w, "%s\n", strings.Join(args, " "))
+}
+
+// startWorkers runs the jobs from covJobs, n at a time, taking them in the
+// order they're queued, so the schedule is kept. Results are sent on the
+// returned channel, which is closed once covJobs is closed and drained.
+func startWorkers(n uint, covJobs chan *exec.Cmd, run func(*exec.Cmd) result) chan result {
+	results := make(chan result, n)
+	var wg sync.WaitGroup
+	for i := uint(0); i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range covJobs {
+				results <- run(j)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
 }
 
-func runJob(j *exec.Cmd, start chan blank, stop chan result) {
-	start <- nothing
-	logCmd(j)
-	out, err := j.CombinedOutput()
+func runJob(j *exec.Cmd, dispatch, cancel chan blank, retries int, memLimit uint64, con *console) result {
+	if isClosed(dispatch) {
+		return result{j: j, e: errNotRun}
+	}
+	con.started(j.Args[len(j.Args)-1])
+	// everything run for the package, and its output, goes in its log
+	var transcript bytes.Buffer
+	logCmd(&transcript, j)
+	began := time.Now()
+	out, err := combinedOutput(j, cancel)
+	if _, failed := err.(*exec.ExitError); failed && memLimit > 0 && outOfMemoryRE.Match(out) {
+		transcript.Write(out)
+		return result{j: j, o: out, e: errOverMemory, d: time.Since(began), log: writeLog(j, transcript.Bytes())}
+	}
+	var flaky *flakyTests
+	if retries > 0 {
+		// tests were run with -json, so failures can be picked out
+		_, failed := err.(*exec.ExitError)
+		if !failed {
+			out, _, _ = parseTestJSON(out)
+			transcript.Write(out)
+		} else {
+			var rerr error
+			out, flaky, rerr = retryFailed(j, out, retries, cancel, &transcript)
+			switch {
+			case rerr != nil:
+				err = rerr
+			case flaky != nil:
+				err = nil
+			}
+		}
+	} else {
+		transcript.Write(out)
+	}
 	switch err.(type) {
 	case *exec.ExitError:
 		cmd := exec.Command("go", append([]string{"test"}, j.Args[5:]...)...) //brittle
-		logCmd(cmd)
-		no, ne := cmd.CombinedOutput()
+		logCmd(&transcript, cmd)
+		no, ne := combinedOutput(cmd, cancel)
 		if ne != nil {
 			out, err = no, ne
+			if retries > 0 {
+				out, _, _ = parseTestJSON(out)
+			}
+		}
+		transcript.Write(out)
+	}
+
+	return result{j: j, o: out, e: err, d: time.Since(began), flaky: flaky, log: writeLog(j, transcript.Bytes())}
+}
+
+// writeLog writes j's transcript next to its profile, and returns where, or
+// "" if it couldn't.
+func writeLog(j *exec.Cmd, transcript []byte) string {
+	profile := profileArg(j)
+	if profile == "" {
+		return ""
+	}
+	path := logpath(profile)
+	if err := ioutil.WriteFile(path, transcript, 0644); err != nil {
+		log.Print(err)
+		return ""
+	}
+	return path
+}
+
+// profileArg is the profile j writes, from its --coverprofile flag.
+func profileArg(j *exec.Cmd) string {
+	for _, a := range j.Args {
+		if strings.HasPrefix(a, "--coverprofile=") {
+			return strings.TrimPrefix(a, "--coverprofile=")
 		}
 	}
+	return ""
+}
+
+// combinedOutput runs c like c.CombinedOutput, but in its own process group,
+// which is terminated if cancel closes, and killed if it hasn't stopped
+// killGrace later.
+func combinedOutput(c *exec.Cmd, cancel chan blank) ([]byte, error) {
+	var out bytes.Buffer
+	c.Stdout = &out
+	c.Stderr = &out
+	setProcessGroup(c)
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	running.add(c)
+	defer running.remove(c)
+
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-cancel:
+		stopProcess(c, done, killGrace)
+		return out.Bytes(), errCancelled
+	}
+}
+
+// stopProcess terminates c, and kills it if it hasn't finished, as reported
+// on done, within grace.
+func stopProcess(c *exec.Cmd, done chan error, grace time.Duration) {
+	terminate(c)
+	select {
+	case <-done:
+	case <-time.After(grace):
+		kill(c)
+		<-done
+	}
+}
+
+// procSet keeps track of running processes.
+type procSet struct {
+	mu    sync.Mutex
+	procs map[*exec.Cmd]blank
+}
+
+func newProcSet() *procSet {
+	return &procSet{procs: make(map[*exec.Cmd]blank)}
+}
+
+func (ps *procSet) add(c *exec.Cmd) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.procs[c] = nothing
+}
 
-	stop <- result{j: j, o: out, e: err}
+func (ps *procSet) remove(c *exec.Cmd) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.procs, c)
+}
+
+// killAll kills every process in the set.
+func (ps *procSet) killAll() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for c := range ps.procs {
+		kill(c)
+	}
+}
+
+func isClosed(c chan blank) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
 }
 
-func profilepath(dir, pkg string) string {
-	return filepath.Join(dir, pathSep.ReplaceAllString(pkg, "-")) + ".coverprofile"
+func (r result) pkg() string {
+	return r.j.Args[len(r.j.Args)-1]
 }
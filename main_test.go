@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkersKeepSchedule(t *testing.T) {
+	dir := tempDir(t, nil)
+
+	h := make(history)
+	h.record("example.com/fast", time.Second, false)
+	h.record("example.com/slow", time.Minute, false)
+	h.record("example.com/mid", 10*time.Second, false)
+	scheduled := importPaths(h.schedule([]pkgInfo{
+		{ImportPath: "example.com/fast"}, {ImportPath: "example.com/mid"}, {ImportPath: "example.com/slow"},
+	}, false))
+	require.Equal(t, []string{"example.com/slow", "example.com/mid", "example.com/fast"}, scheduled)
+
+	covJobs := make(chan *exec.Cmd, 1)
+	go queueJobs(covJobs, newStopper().c, dir, map[string]string{}, "count", nil, scheduled)
+
+	var mu sync.Mutex
+	var started []string
+	results := startWorkers(1, covJobs, func(j *exec.Cmd) result {
+		mu.Lock()
+		started = append(started, j.Args[len(j.Args)-1])
+		mu.Unlock()
+		// the first job takes long enough for the rest to be waiting
+		if len(started) == 1 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return result{j: j}
+	})
+	for range results {
+	}
+	assert.Equal(t, scheduled, started)
+}
+
+func TestResumeAfterFailure(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs engulf")
+	}
+	bin := filepath.Join(tempDir(t, nil), "engulf")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	out, err := build.CombinedOutput()
+	require.NoError(t, err, "%s", out)
+
+	dir := tempDir(t, map[string]string{
+		"go.mod":         "module example.com/app\n\ngo 1.16\n",
+		"a/a.go":         "package a\n\nfunc A() int {\n\treturn 1\n}\n",
+		"a/a_test.go":    "package a\n\nimport \"testing\"\n\nfunc TestA(t *testing.T) {\n\tA()\n}\n",
+		"b/b.go":         "package b\n\nfunc B() int {\n\treturn 1\n}\n",
+		"b/b_test.go":    "package b\n\nimport \"testing\"\n\nfunc TestB(t *testing.T) {\n\tt.Fatal(B())\n}\n",
+		"cov/.gitignore": "*\n",
+	})
+	git := func(args ...string) {
+		c := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		c.Dir = dir
+		out, err := c.CombinedOutput()
+		require.NoError(t, err, "%s", out)
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "app")
+
+	engulf := func(args ...string) (string, error) {
+		c := exec.Command(bin, append([]string{"--coverdir=" + filepath.Join(dir, "cov"), "--order=list"}, args...)...)
+		c.Dir = dir
+		out, err := c.CombinedOutput()
+		return string(out), err
+	}
+	out1, err := engulf("./...")
+	require.Error(t, err, out1)
+
+	resumed, err := engulf("--resume", "./...")
+	assert.Error(t, err, "b failed in the run being resumed")
+	assert.Contains(t, resumed, "0 passed, 1 failed")
+	assert.Contains(t, resumed, "example.com/app/b (log: ")
+}
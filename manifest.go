@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/tools/cover"
+)
+
+const manifestFile = "manifest.json"
+
+// Package outcomes, as recorded in the manifest
+const (
+	outcomePassed     = "passed"
+	outcomeFailed     = "failed"
+	outcomeOverMemory = "over memory limit"
+	outcomeCancelled  = "cancelled"
+	outcomeNotRun     = "not run"
+)
+
+// runManifest records how each package fared in the latest run that
+// included it, and where its profile and log are, so later runs can pick up
+// where it left off.
+type runManifest struct {
+	Packages map[string]*pkgRecord `json:"packages"`
+}
+
+type pkgRecord struct {
+	Outcome  string `json:"outcome"`
+	Profile  string `json:"profile"`
+	Log      string `json:"log,omitempty"`
+	Flags    string `json:"flags,omitempty"`
+	Revision string `json:"revision,omitempty"`
+	// Files holds hashes of the source files the profile covers, as they
+	// were when it was made
+	Files map[string]string `json:"files,omitempty"`
+}
+
+func newManifest() *runManifest {
+	return &runManifest{Packages: make(map[string]*pkgRecord)}
+}
+
+func loadManifest(dir string) (*runManifest, error) {
+	f, err := os.Open(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := newManifest()
+	if err := json.NewDecoder(f).Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Packages == nil {
+		m.Packages = make(map[string]*pkgRecord)
+	}
+	return m, nil
+}
+
+// save writes the manifest atomically, since it's rewritten as each package
+// finishes, and a run killed mid-write mustn't leave it unreadable.
+func (m *runManifest) save(dir string) error {
+	return writeAtomically(filepath.Join(dir, manifestFile), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	})
+}
+
+func (m *runManifest) record(pkg string, r *pkgRecord) {
+	m.Packages[pkg] = r
+}
+
+func (m *runManifest) passed(pkg string) bool {
+	r, ok := m.Packages[pkg]
+	return ok && r.Outcome == outcomePassed
+}
+
+// finished reports whether pkg ran to completion, with the same flags and on
+// the same source revision, leaving a usable profile behind.
+func (m *runManifest) finished(pkg, flags, revision string) bool {
+	r, ok := m.Packages[pkg]
+	if !ok || r.Flags != flags || r.Revision != revision {
+		return false
+	}
+	if r.Outcome != outcomePassed && r.Outcome != outcomeFailed {
+		return false
+	}
+	if fi, err := os.Stat(r.Profile); err != nil || fi.Size() == 0 {
+		return false
+	}
+	_, err := cover.ParseProfiles(r.Profile)
+	return err == nil
+}
+
+// resume splits tested into the packages a resumed run still has to run, and
+// those the run being resumed finished. Of those, the ones that failed are
+// listed in failed too, with where their logs are, since they still fail the
+// run.
+func (m *runManifest) resume(tested []pkgInfo, flags map[string]string, revision string) (toRun []pkgInfo, done, failed []string) {
+	for _, p := range tested {
+		pkg := p.ImportPath
+		if !m.finished(pkg, flags[pkg], revision) {
+			toRun = append(toRun, p)
+			continue
+		}
+		done = append(done, pkg)
+		if r := m.Packages[pkg]; r.Outcome == outcomeFailed {
+			if r.Log == "" {
+				failed = append(failed, pkg)
+			} else {
+				failed = append(failed, pkg+" (log: "+r.Log+")")
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	dir := tempDir(t, nil)
+
+	_, err := loadManifest(dir)
+	assert.Error(t, err)
+
+	m := newManifest()
+	m.record("example.com/a", &pkgRecord{Outcome: outcomePassed, Profile: profilepath(dir, "example.com/a")})
+	m.record("example.com/b", &pkgRecord{Outcome: outcomeFailed, Profile: profilepath(dir, "example.com/b")})
+	require.NoError(t, m.save(dir))
+
+	loaded, err := loadManifest(dir)
+	require.NoError(t, err)
+	assert.Equal(t, m, loaded)
+	assert.True(t, loaded.passed("example.com/a"))
+	assert.False(t, loaded.passed("example.com/b"))
+	assert.False(t, loaded.passed("example.com/c"))
+	assert.Equal(t, profilepath(dir, "example.com/b"), loaded.Packages["example.com/b"].Profile)
+
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "no temporary files left behind")
+	assert.Equal(t, manifestFile, entries[0].Name())
+}
+
+func TestManifestFinished(t *testing.T) {
+	dir := tempDir(t, map[string]string{
+		"pkgs/good.coverprofile":  "mode: count\nexample.com/a/a.go:1.1,2.2 1 1\n",
+		"pkgs/empty.coverprofile": "",
+	})
+	good, empty := profilepath(dir, "good"), profilepath(dir, "empty")
+
+	m := newManifest()
+	m.record("good", &pkgRecord{Outcome: outcomeFailed, Profile: good, Flags: "-x", Revision: "abc"})
+	m.record("empty", &pkgRecord{Outcome: outcomePassed, Profile: empty, Flags: "-x", Revision: "abc"})
+	m.record("cancelled", &pkgRecord{Outcome: outcomeCancelled, Profile: good, Flags: "-x", Revision: "abc"})
+
+	assert.True(t, m.finished("good", "-x", "abc"))
+	assert.False(t, m.finished("good", "-y", "abc"))
+	assert.False(t, m.finished("good", "-x", "def"))
+	assert.False(t, m.finished("empty", "-x", "abc"))
+	assert.False(t, m.finished("cancelled", "-x", "abc"))
+	assert.False(t, m.finished("missing", "-x", "abc"))
+}
+
+func TestManifestResume(t *testing.T) {
+	dir := tempDir(t, map[string]string{
+		"pkgs/example.com/a.coverprofile": "mode: count\nexample.com/a/a.go:1.1,2.2 1 1\n",
+		"pkgs/example.com/b.coverprofile": "mode: count\nexample.com/b/b.go:1.1,2.2 1 0\n",
+	})
+	m := newManifest()
+	for pkg, outcome := range map[string]string{"example.com/a": outcomePassed, "example.com/b": outcomeFailed, "example.com/c": outcomeCancelled} {
+		profile := profilepath(dir, pkg)
+		m.record(pkg, &pkgRecord{Outcome: outcome, Profile: profile, Log: logpath(profile), Flags: "-x", Revision: "abc"})
+	}
+	tested := []pkgInfo{{ImportPath: "example.com/a"}, {ImportPath: "example.com/b"}, {ImportPath: "example.com/c"}}
+	flags := map[string]string{"example.com/a": "-x", "example.com/b": "-x", "example.com/c": "-x"}
+
+	toRun, done, failed := m.resume(tested, flags, "abc")
+	assert.Equal(t, []string{"example.com/c"}, importPaths(toRun))
+	assert.Equal(t, []string{"example.com/a", "example.com/b"}, done)
+	assert.Equal(t, []string{"example.com/b (log: " + logpath(profilepath(dir, "example.com/b")) + ")"}, failed)
+}
@@ -1,4 +1,4 @@
-package main
+package merge
 
 import "golang.org/x/tools/cover"
 
@@ -155,10 +155,10 @@ func mergeOverlap(first, second cover.ProfileBlock) []cover.ProfileBlock {
 			Count:     first.Count,
 		},
 		cover.ProfileBlock{
-			StartCol:  first.StartCol,
-			StartLine: first.StartLine,
-			EndCol:    second.EndCol,
-			EndLine:   second.EndLine,
+			StartCol:  second.StartCol,
+			StartLine: second.StartLine,
+			EndCol:    first.EndCol,
+			EndLine:   first.EndLine,
 			NumStmt:   y,
 			Count:     first.Count + second.Count,
 		},
@@ -202,15 +202,15 @@ func mergeCommonEnd(first, second cover.ProfileBlock) []cover.ProfileBlock {
 			StartCol:  first.StartCol,
 			StartLine: first.StartLine,
 			EndCol:    second.StartCol,
-			EndLine:   second.StartCol,
+			EndLine:   second.StartLine,
 			NumStmt:   first.NumStmt - second.NumStmt,
 			Count:     first.Count,
 		},
 		cover.ProfileBlock{
 			StartCol:  second.StartCol,
-			StartLine: second.StartCol,
+			StartLine: second.StartLine,
 			EndCol:    second.EndCol,
-			EndLine:   second.EndCol,
+			EndLine:   second.EndLine,
 			NumStmt:   second.NumStmt,
 			Count:     first.Count + second.Count,
 		},
@@ -0,0 +1,33 @@
+package merge_test
+
+import (
+	"log"
+	"os"
+
+	"github.com/nyarly/engulf/merge"
+	"golang.org/x/tools/cover"
+)
+
+func Example() {
+	m, err := merge.NewMerger(merge.Union)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, source := range []string{"unit.out", "integration.out"} {
+		profs, err := cover.ParseProfiles(source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := m.Add(source, profs); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, _, err := m.Unify(); err != nil {
+		log.Fatal(err)
+	}
+	for _, mode := range m.Modes() {
+		if err := m.WriteProfile(os.Stdout, mode); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package merge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/tools/cover"
+)
+
+type x cover.ProfileBlock
+type xp struct {
+	l, r x
+	n    int
+}
+
+func testMerge(t *testing.T, p *xp) []cover.ProfileBlock {
+	bls := mergeBlockPair(cover.ProfileBlock(p.l), cover.ProfileBlock(p.r))
+	assert.Len(t, bls, p.n, "\n  %#v\n  %#v", p.l, p.r)
+	return bls
+}
+
+func TestMergePairs(t *testing.T) {
+	pairs := []xp{
+		xp{x{0, 0, 0, 0, 0, 0}, x{1, 1, 1, 1, 0, 0}, 0},
+		xp{x{40, 60, 45, 24, 2, 0}, x{45, 24, 46, 26, 1, 0}, 0},
+		xp{x{45, 24, 46, 26, 1, 0}, x{40, 60, 45, 24, 2, 0}, 0},
+		xp{x{1, 1, 1, 1, 0, 0}, x{1, 1, 1, 1, 0, 0}, 1},
+		xp{x{0, 0, 2, 2, 0, 0}, x{1, 1, 2, 2, 0, 0}, 2}, //same end
+		xp{x{1, 1, 2, 2, 0, 0}, x{0, 0, 2, 2, 0, 0}, 2}, //same end
+		xp{x{0, 0, 2, 2, 0, 0}, x{0, 0, 1, 1, 0, 0}, 2}, //same begin
+		xp{x{0, 0, 1, 1, 0, 0}, x{0, 0, 2, 2, 0, 0}, 2}, //same begin
+		xp{x{0, 0, 2, 2, 0, 0}, x{1, 1, 3, 3, 0, 0}, 3}, //left overlap
+		xp{x{1, 1, 3, 3, 0, 0}, x{0, 0, 2, 2, 0, 0}, 3}, //right overlap
+		xp{x{0, 0, 3, 3, 0, 0}, x{1, 1, 2, 2, 0, 0}, 3}, //left outer
+		xp{x{1, 1, 2, 2, 0, 0}, x{0, 0, 3, 3, 0, 0}, 3}, //right outer
+	}
+
+	for _, p := range pairs {
+		testMerge(t, &p)
+	}
+}
+func TestMergePairCoordinates(t *testing.T) {
+	// the common end: the longer block is split where the shorter starts
+	assert.Equal(t, lb(
+		bk(1, 5, 3, 2, 1, 1),
+		bk(3, 2, 4, 8, 2, 3),
+	), mergeBlockPair(bk(1, 5, 4, 8, 3, 1), bk(3, 2, 4, 8, 2, 2)))
+
+	// the overlap: before it, the overlap itself, and after it
+	assert.Equal(t, lb(
+		bk(1, 5, 3, 2, 1, 1),
+		bk(3, 2, 4, 8, 1, 3),
+		bk(4, 8, 6, 1, 1, 2),
+	), mergeBlockPair(bk(1, 5, 4, 8, 2, 1), bk(3, 2, 6, 1, 1, 2)))
+}
+
+func TestMergerCopiesBlocks(t *testing.T) {
+	m, err := NewMerger(Union)
+	require.NoError(t, err)
+	blocks := lb(bk(1, 1, 2, 1, 1, 1))
+	require.NoError(t, m.Add("one", []*cover.Profile{{FileName: "a.go", Mode: ModeCount, Blocks: blocks}}))
+
+	m.Profiles(ModeCount)[0].Blocks[0].Count = 10
+	assert.Equal(t, 1, blocks[0].Count, "the caller's blocks are left alone")
+}
+
+func lb(blks ...cover.ProfileBlock) []cover.ProfileBlock {
+	return blks
+}
+
+func blk(start, end int) cover.ProfileBlock {
+	return cover.ProfileBlock{StartLine: start, EndLine: end}
+}
+
+func bk(sl, sc, el, ec, s, c int) cover.ProfileBlock {
+	return cover.ProfileBlock{sl, sc, el, ec, s, c}
+}
+
+func TestMergeProfiles(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Len(mergeBlocks(lb(blk(0, 0), blk(4, 4), blk(2, 2), blk(7, 8)), lb(blk(1, 1), blk(5, 5))), 6)
+	assert.Len(mergeBlocks(lb(blk(0, 7)), lb(blk(1, 5))), 3)
+	assert.Len(mergeBlocks(lb(blk(0, 7), blk(8, 9)), lb(blk(1, 5))), 4)
+	assert.Len(mergeBlocks(lb(bk(30, 41, 32, 2, 1, 0)), lb(bk(35, 52, 38, 2, 2, 0))), 2)
+
+	assert.Len(mergeBlocks(
+		lb(
+			bk(40, 60, 45, 24, 2, 0),
+			bk(45, 24, 46, 26, 1, 0),
+		),
+		lb(
+			bk(40, 60, 45, 24, 2, 0),
+			bk(45, 24, 46, 26, 1, 0),
+		),
+	),
+		2,
+	)
+
+	assert.Len(mergeBlocks(
+		lb(
+			bk(30, 41, 32, 2, 1, 0),
+			bk(35, 52, 38, 2, 2, 0),
+			bk(40, 60, 45, 24, 2, 0),
+			bk(45, 24, 46, 26, 1, 0),
+			bk(46, 26, 48, 9, 2, 0),
+			bk(51, 2, 51, 24, 1, 0),
+			bk(51, 24, 52, 26, 1, 0),
+			bk(52, 26, 54, 9, 2, 0),
+			bk(57, 2, 57, 24, 1, 0),
+			bk(57, 24, 58, 23, 1, 0),
+			bk(58, 23, 60, 9, 2, 0),
+			bk(63, 2, 63, 24, 1, 0),
+			bk(63, 24, 64, 33, 1, 0),
+			bk(64, 33, 65, 39, 1, 0),
+			bk(65, 39, 67, 5, 1, 0),
+			bk(69, 3, 69, 27, 1, 0),
+			bk(69, 27, 70, 33, 1, 0),
+			bk(70, 33, 72, 5, 1, 0),
+			bk(75, 2, 75, 11, 1, 0),
+		),
+		lb(
+			bk(30, 41, 32, 2, 1, 0),
+			bk(35, 52, 38, 2, 2, 0),
+			bk(40, 60, 45, 24, 2, 0),
+			bk(45, 24, 46, 26, 1, 0),
+			bk(46, 26, 48, 9, 2, 0),
+			bk(51, 2, 51, 24, 1, 0),
+			bk(51, 24, 52, 26, 1, 0),
+			bk(52, 26, 54, 9, 2, 0),
+			bk(57, 2, 57, 24, 1, 0),
+			bk(57, 24, 58, 23, 1, 0),
+			bk(58, 23, 60, 9, 2, 0),
+			bk(63, 2, 63, 24, 1, 0),
+			bk(63, 24, 64, 33, 1, 0),
+			bk(64, 33, 65, 39, 1, 0),
+			bk(65, 39, 67, 5, 1, 0),
+			bk(69, 3, 69, 27, 1, 0),
+			bk(69, 27, 70, 33, 1, 0),
+			bk(70, 33, 72, 5, 1, 0),
+			bk(75, 2, 75, 11, 1, 0),
+		),
+	),
+		19,
+	)
+}
+
+func TestMergerConflicts(t *testing.T) {
+	whole := func() []*cover.Profile {
+		return []*cover.Profile{
+			{FileName: "a.go", Mode: "count", Blocks: lb(bk(1, 1, 100, 1, 10, 1))},
+			{FileName: "b.go", Mode: "count", Blocks: lb(bk(1, 1, 2, 1, 1, 1))},
+		}
+	}
+	pieces := func() []*cover.Profile {
+		return []*cover.Profile{
+			{FileName: "a.go", Mode: "count", Blocks: lb(bk(2, 1, 3, 1, 1, 5), bk(5, 1, 6, 1, 1, 0), bk(8, 1, 9, 1, 1, 0), bk(200, 1, 201, 1, 1, 2))},
+			{FileName: "b.go", Mode: "count", Blocks: lb(bk(1, 1, 2, 1, 1, 2))},
+		}
+	}
+
+	m, err := NewMerger(Union)
+	require.NoError(t, err)
+	require.NoError(t, m.Add("one", whole()))
+	require.NoError(t, m.Add("two", pieces()))
+	require.Len(t, m.Conflicts(), 1)
+	assert.Equal(t, "a.go: blocks from two don't line up with those from one (merging 1 and 4 blocks made 10)", m.Conflicts()[0].String())
+	assert.Equal(t, lb(bk(1, 1, 100, 1, 10, 5), bk(200, 1, 201, 1, 1, 2)), m.Profiles("count")[0].Blocks)
+	assert.Equal(t, lb(bk(1, 1, 2, 1, 1, 3)), m.Profiles("count")[1].Blocks, "the rest still merge")
+
+	m, err = NewMerger(Drop)
+	require.NoError(t, err)
+	require.NoError(t, m.Add("one", whole()))
+	require.NoError(t, m.Add("two", pieces()))
+	require.NoError(t, m.Add("three", whole()))
+	assert.False(t, m.Has("count", "a.go"))
+	assert.True(t, m.Dropped("a.go"))
+	assert.False(t, m.Dropped("b.go"))
+	assert.Equal(t, lb(bk(1, 1, 2, 1, 1, 4)), m.Profiles("count")[0].Blocks)
+
+	m, err = NewMerger(Fail)
+	require.NoError(t, err)
+	require.NoError(t, m.Add("one", whole()))
+	assert.Error(t, m.Add("two", pieces()))
+
+	_, err = NewMerger("shrug")
+	assert.Error(t, err)
+}
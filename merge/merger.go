@@ -0,0 +1,335 @@
+// Package merge combines Go coverage profiles, as read by
+// golang.org/x/tools/cover, from any number of test runs into one.
+//
+// Unlike concatenating profiles, merging reconciles blocks for the same file
+// that don't coincide (as happens when packages are tested with different
+// -coverpkg settings), splitting them where they overlap and adding up their
+// counts.
+package merge
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/cover"
+)
+
+// Cover modes
+const (
+	ModeSet    = "set"
+	ModeCount  = "count"
+	ModeAtomic = "atomic"
+)
+
+// What to do about a file whose blocks from different profiles don't line up
+const (
+	Union = "union" // keep the first blocks, with the highest count for each line
+	Drop  = "drop"  // leave the file out
+	Fail  = "fail"  // return a *Conflict from Add
+)
+
+// conflictFactor is how far merging can split blocks up before profiles are
+// taken to disagree about a file. Profiles of the same source merge into
+// about as many blocks as the larger of them has, but ones made from
+// different versions of a file cut each other's blocks into pieces. Merging
+// big and small blocks (big >= small) into more than
+// big + conflictFactor*small blocks is a conflict.
+const conflictFactor = 3
+
+// Conflict is a file whose blocks from one profile didn't line up with those
+// already merged from others: merging them made more blocks than the larger
+// had plus three times the smaller, which happens when profiles were made from
+// different versions of the file.
+type Conflict struct {
+	FileName string
+	Sources  []string // the profiles merged before the conflict
+	Incoming string   // the profile that conflicted
+	// how many blocks there were, how many were added, and how many merging
+	// them made
+	Had, Adding, Made int
+}
+
+func (c *Conflict) String() string {
+	return fmt.Sprintf("%s: blocks from %s don't line up with those from %s (merging %d and %d blocks made %d)",
+		c.FileName, sourceName(c.Incoming), strings.Join(sourceNames(c.Sources), ", "), c.Had, c.Adding, c.Made)
+}
+
+func (c *Conflict) Error() string {
+	return "conflicting coverage for " + c.String()
+}
+
+func sourceName(source string) string {
+	if source == "" {
+		return "an unnamed profile"
+	}
+	return source
+}
+
+func sourceNames(sources []string) []string {
+	var names []string
+	for _, s := range sources {
+		names = append(names, sourceName(s))
+	}
+	return names
+}
+
+// Merger merges profiles. Counts are added up, except in set mode, where a
+// block ran if it ran in any profile. Profiles in different modes are kept
+// apart until Unify brings them together.
+type Merger struct {
+	policy    string
+	profiles  map[string]map[string]*cover.Profile // by mode, then file name
+	sources   map[string][]string                  // the profiles each file's coverage came from
+	dropped   map[string]bool
+	conflicts []*Conflict
+}
+
+// NewMerger makes a Merger that deals with conflicting files according to
+// policy: Union, Drop or Fail.
+func NewMerger(policy string) (*Merger, error) {
+	switch policy {
+	case Union, Drop, Fail:
+	default:
+		return nil, fmt.Errorf("unknown conflict policy %q", policy)
+	}
+	return &Merger{
+		policy:   policy,
+		profiles: make(map[string]map[string]*cover.Profile),
+		sources:  make(map[string][]string),
+		dropped:  make(map[string]bool),
+	}, nil
+}
+
+// Add merges profs in. source names where they came from, for reporting
+// conflicts; it can be "". With Fail, a conflict is returned as a *Conflict,
+// and nothing more from profs is merged.
+func (m *Merger) Add(source string, profs []*cover.Profile) error {
+	for _, prof := range profs {
+		if m.dropped[prof.FileName] {
+			continue
+		}
+		moded, ok := m.profiles[prof.Mode]
+		if !ok {
+			moded = make(map[string]*cover.Profile)
+			m.profiles[prof.Mode] = moded
+		}
+		filed, ok := moded[prof.FileName]
+		if !ok {
+			// copied, so the caller's blocks aren't changed as more are merged
+			blocks := append([]cover.ProfileBlock(nil), prof.Blocks...)
+			if prof.Mode == ModeSet {
+				blocks = setBlocks(blocks)
+			}
+			moded[prof.FileName] = &cover.Profile{
+				FileName: prof.FileName,
+				Mode:     prof.Mode,
+				Blocks:   blocks,
+			}
+			m.sources[prof.FileName] = append(m.sources[prof.FileName], source)
+			continue
+		}
+
+		big := len(prof.Blocks)
+		sml := len(filed.Blocks)
+		newList := mergeBlocks(filed.Blocks, prof.Blocks)
+		if big < sml {
+			big, sml = sml, big
+		}
+		if len(newList) > big+conflictFactor*sml {
+			conflict := &Conflict{
+				FileName: prof.FileName,
+				Sources:  append([]string(nil), m.sources[prof.FileName]...),
+				Incoming: source,
+				Had:      len(filed.Blocks),
+				Adding:   len(prof.Blocks),
+				Made:     len(newList),
+			}
+			m.conflicts = append(m.conflicts, conflict)
+			switch m.policy {
+			case Fail:
+				return conflict
+			case Drop:
+				for _, moded := range m.profiles {
+					delete(moded, prof.FileName)
+				}
+				m.dropped[prof.FileName] = true
+				continue
+			default:
+				newList = lineUnion(filed.Blocks, prof.Blocks)
+			}
+		}
+		if prof.Mode == ModeSet {
+			// merging adds up counts, but in set mode they're whether a block
+			// ran
+			newList = setBlocks(newList)
+		}
+		filed.Blocks = newList
+		m.sources[prof.FileName] = append(m.sources[prof.FileName], source)
+	}
+	return nil
+}
+
+// Dropped reports whether fileName was left out because of a conflict, under
+// Drop. Coverage added for it since has been left out too.
+func (m *Merger) Dropped(fileName string) bool {
+	return m.dropped[fileName]
+}
+
+// Conflicts lists the conflicts Add has come across.
+func (m *Merger) Conflicts() []*Conflict {
+	return m.conflicts
+}
+
+// Modes lists the modes of the profiles merged so far.
+func (m *Merger) Modes() []string {
+	var modes []string
+	for mode := range m.profiles {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	return modes
+}
+
+// Has reports whether there's coverage for fileName in mode.
+func (m *Merger) Has(mode, fileName string) bool {
+	_, ok := m.profiles[mode][fileName]
+	return ok
+}
+
+// Profiles returns the merged profiles in mode, sorted by file name. They
+// belong to the Merger, but can be changed before they're written.
+func (m *Merger) Profiles(mode string) []*cover.Profile {
+	var list []*cover.Profile
+	for _, prof := range m.profiles[mode] {
+		list = append(list, prof)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].FileName < list[j].FileName })
+	return list
+}
+
+// Unify merges profiles made in different modes into the least informative
+// mode they have in common: count and atomic profiles both count, so they
+// become count, but mixed with set, all anyone can say is whether a block
+// ran, so they become set. It returns the modes it found, and the one they
+// were merged into, which is "" if there was nothing to unify. Files whose
+// blocks don't line up across modes are dealt with by the Merger's policy;
+// with Fail, the *Conflict is returned and nothing is unified.
+func (m *Merger) Unify() (from []string, to string, err error) {
+	from = m.Modes()
+	if len(from) < 2 {
+		return from, "", nil
+	}
+	to = ModeCount
+	if _, ok := m.profiles[ModeSet]; ok {
+		to = ModeSet
+	}
+
+	unified, _ := NewMerger(m.policy)
+	for name := range m.dropped {
+		unified.dropped[name] = true
+	}
+	for _, mode := range from {
+		var profs []*cover.Profile
+		for _, prof := range m.Profiles(mode) {
+			profs = append(profs, &cover.Profile{FileName: prof.FileName, Mode: to, Blocks: prof.Blocks})
+		}
+		if err := unified.Add("the "+mode+" profiles", profs); err != nil {
+			return from, to, err
+		}
+	}
+	m.profiles = unified.profiles
+	m.dropped = unified.dropped
+	m.conflicts = append(m.conflicts, unified.conflicts...)
+	return from, to, nil
+}
+
+// WriteProfile writes the merged profiles in mode to w.
+func (m *Merger) WriteProfile(w io.Writer, mode string) error {
+	return WriteProfiles(w, mode, m.Profiles(mode))
+}
+
+// WriteProfiles writes profs to w as a profile in mode, sorted by file name
+// and then position, so that the same coverage is always written the same
+// way.
+func WriteProfiles(w io.Writer, mode string, profs []*cover.Profile) error {
+	profs = append([]*cover.Profile(nil), profs...)
+	sort.Slice(profs, func(i, j int) bool { return profs[i].FileName < profs[j].FileName })
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "mode: %s\n", mode)
+
+	for _, p := range profs {
+		blocks := append([]cover.ProfileBlock(nil), p.Blocks...)
+		if mode == ModeSet {
+			// set mode only has 0 and 1, whatever profs came with
+			blocks = setBlocks(blocks)
+		}
+		sort.SliceStable(blocks, func(i, j int) bool { return blockLess(blocks[i], blocks[j]) })
+		for _, b := range blocks {
+			fmt.Fprintf(bw, "%s:%d.%d,%d.%d %d %d\n",
+				p.FileName,
+				b.StartLine, b.StartCol, b.EndLine, b.EndCol,
+				b.NumStmt, b.Count,
+			)
+		}
+	}
+	return bw.Flush()
+}
+
+// lineUnion is the fallback for blocks that don't line up: it keeps the
+// existing blocks, and adds the incoming blocks that don't overlap any of
+// them. One that does overlap is dropped, but the blocks it overlaps get its
+// count if it's higher, so that no line counts less than it did in either.
+func lineUnion(existing, incoming []cover.ProfileBlock) []cover.ProfileBlock {
+	union := append([]cover.ProfileBlock(nil), existing...)
+	for _, in := range incoming {
+		overlapped := false
+		for i, ex := range existing {
+			if !Before(in.StartLine, in.StartCol, ex.EndLine, ex.EndCol) || !Before(ex.StartLine, ex.StartCol, in.EndLine, in.EndCol) {
+				continue
+			}
+			overlapped = true
+			if in.Count > union[i].Count {
+				union[i].Count = in.Count
+			}
+		}
+		if !overlapped {
+			union = append(union, in)
+		}
+	}
+	sort.SliceStable(union, func(i, j int) bool { return blockLess(union[i], union[j]) })
+	return union
+}
+
+// setBlocks turns counts into whether a block ran at all.
+func setBlocks(blocks []cover.ProfileBlock) []cover.ProfileBlock {
+	set := make([]cover.ProfileBlock, len(blocks))
+	for i, b := range blocks {
+		if b.Count > 1 {
+			b.Count = 1
+		}
+		set[i] = b
+	}
+	return set
+}
+
+func blockLess(a, b cover.ProfileBlock) bool {
+	switch {
+	case a.StartLine != b.StartLine:
+		return a.StartLine < b.StartLine
+	case a.StartCol != b.StartCol:
+		return a.StartCol < b.StartCol
+	case a.EndLine != b.EndLine:
+		return a.EndLine < b.EndLine
+	default:
+		return a.EndCol < b.EndCol
+	}
+}
+
+// Before reports whether line.col a comes strictly before line.col b.
+func Before(aLine, aCol, bLine, bCol int) bool {
+	return aLine < bLine || aLine == bLine && aCol < bCol
+}
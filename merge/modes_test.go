@@ -0,0 +1,90 @@
+package merge
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/tools/cover"
+)
+
+func merged(t *testing.T, profs ...*cover.Profile) *Merger {
+	m, err := NewMerger(Union)
+	require.NoError(t, err)
+	require.NoError(t, m.Add("", profs))
+	return m
+}
+
+func TestUnify(t *testing.T) {
+	m := merged(t,
+		&cover.Profile{FileName: "a.go", Mode: ModeCount, Blocks: lb(bk(1, 1, 2, 2, 1, 3))},
+		&cover.Profile{FileName: "a.go", Mode: ModeAtomic, Blocks: lb(bk(1, 1, 2, 2, 1, 2))},
+		&cover.Profile{FileName: "b.go", Mode: ModeAtomic, Blocks: lb(bk(1, 1, 2, 2, 1, 0))},
+	)
+	from, to, err := m.Unify()
+	require.NoError(t, err)
+	assert.Equal(t, []string{ModeAtomic, ModeCount}, from)
+	assert.Equal(t, ModeCount, to)
+	assert.Equal(t, []string{ModeCount}, m.Modes())
+	profs := m.Profiles(ModeCount)
+	require.Len(t, profs, 2)
+	assert.Equal(t, lb(bk(1, 1, 2, 2, 1, 5)), profs[0].Blocks)
+	assert.Equal(t, ModeCount, profs[1].Mode)
+
+	m = merged(t,
+		&cover.Profile{FileName: "a.go", Mode: ModeCount, Blocks: lb(bk(1, 1, 2, 2, 1, 3))},
+		&cover.Profile{FileName: "a.go", Mode: ModeSet, Blocks: lb(bk(1, 1, 2, 2, 1, 1))},
+	)
+	_, to, err = m.Unify()
+	require.NoError(t, err)
+	assert.Equal(t, ModeSet, to)
+	assert.Equal(t, lb(bk(1, 1, 2, 2, 1, 1)), m.Profiles(ModeSet)[0].Blocks)
+	var buf bytes.Buffer
+	require.NoError(t, m.WriteProfile(&buf, ModeSet))
+	assert.Equal(t, "mode: set\na.go:1.1,2.2 1 1\n", buf.String())
+
+	m = merged(t, &cover.Profile{FileName: "a.go", Mode: ModeAtomic})
+	_, to, err = m.Unify()
+	require.NoError(t, err)
+	assert.Empty(t, to)
+	assert.Equal(t, []string{ModeAtomic}, m.Modes())
+}
+
+func TestSetModeMerge(t *testing.T) {
+	m := merged(t,
+		&cover.Profile{FileName: "a.go", Mode: ModeSet, Blocks: lb(bk(1, 1, 2, 2, 1, 1), bk(3, 1, 4, 2, 1, 0))},
+		&cover.Profile{FileName: "a.go", Mode: ModeSet, Blocks: lb(bk(1, 1, 2, 2, 1, 1), bk(3, 1, 4, 2, 1, 1))},
+		&cover.Profile{FileName: "a.go", Mode: ModeSet, Blocks: lb(bk(1, 1, 2, 2, 1, 1), bk(3, 1, 4, 2, 1, 0))},
+	)
+	assert.Equal(t, lb(bk(1, 1, 2, 2, 1, 1), bk(3, 1, 4, 2, 1, 1)), m.Profiles(ModeSet)[0].Blocks, "ran in any")
+}
+
+func TestUnifyConflicts(t *testing.T) {
+	profs := func() []*cover.Profile {
+		return []*cover.Profile{
+			{FileName: "a.go", Mode: ModeCount, Blocks: lb(bk(1, 1, 100, 1, 10, 1))},
+			{FileName: "a.go", Mode: ModeAtomic, Blocks: lb(bk(2, 1, 3, 1, 1, 5), bk(5, 1, 6, 1, 1, 0), bk(8, 1, 9, 1, 1, 0), bk(200, 1, 201, 1, 1, 2))},
+			{FileName: "b.go", Mode: ModeAtomic, Blocks: lb(bk(1, 1, 2, 1, 1, 1))},
+		}
+	}
+
+	m, err := NewMerger(Drop)
+	require.NoError(t, err)
+	require.NoError(t, m.Add("", profs()))
+	require.Empty(t, m.Conflicts(), "kept apart until unified")
+	_, _, err = m.Unify()
+	require.NoError(t, err)
+	require.Len(t, m.Conflicts(), 1)
+	assert.Equal(t, "a.go: blocks from the count profiles don't line up with those from the atomic profiles (merging 4 and 1 blocks made 10)", m.Conflicts()[0].String())
+	assert.True(t, m.Dropped("a.go"))
+	assert.False(t, m.Has(ModeCount, "a.go"))
+	assert.True(t, m.Has(ModeCount, "b.go"))
+
+	m, err = NewMerger(Fail)
+	require.NoError(t, err)
+	require.NoError(t, m.Add("", profs()))
+	_, _, err = m.Unify()
+	assert.Error(t, err)
+	assert.Equal(t, []string{ModeAtomic, ModeCount}, m.Modes(), "left as it was")
+}
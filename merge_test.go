@@ -1,121 +1,78 @@
 package main
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/tools/cover"
 )
 
-type x cover.ProfileBlock
-type xp struct {
-	l, r x
-	n    int
+func lb(blks ...cover.ProfileBlock) []cover.ProfileBlock {
+	return blks
 }
 
-func testMerge(t *testing.T, p *xp) []cover.ProfileBlock {
-	bls := mergeBlockPair(cover.ProfileBlock(p.l), cover.ProfileBlock(p.r))
-	assert.Len(t, bls, p.n, "\n  %#v\n  %#v", p.l, p.r)
-	return bls
+func bk(sl, sc, el, ec, s, c int) cover.ProfileBlock {
+	return cover.ProfileBlock{sl, sc, el, ec, s, c}
 }
 
-func TestMergePairs(t *testing.T) {
-	pairs := []xp{
-		xp{x{0, 0, 0, 0, 0, 0}, x{1, 1, 1, 1, 0, 0}, 0},
-		xp{x{40, 60, 45, 24, 2, 0}, x{45, 24, 46, 26, 1, 0}, 0},
-		xp{x{45, 24, 46, 26, 1, 0}, x{40, 60, 45, 24, 2, 0}, 0},
-		xp{x{1, 1, 1, 1, 0, 0}, x{1, 1, 1, 1, 0, 0}, 1},
-		xp{x{0, 0, 2, 2, 0, 0}, x{1, 1, 2, 2, 0, 0}, 2}, //same end
-		xp{x{1, 1, 2, 2, 0, 0}, x{0, 0, 2, 2, 0, 0}, 2}, //same end
-		xp{x{0, 0, 2, 2, 0, 0}, x{0, 0, 1, 1, 0, 0}, 2}, //same begin
-		xp{x{0, 0, 1, 1, 0, 0}, x{0, 0, 2, 2, 0, 0}, 2}, //same begin
-		xp{x{0, 0, 2, 2, 0, 0}, x{1, 1, 3, 3, 0, 0}, 3}, //left overlap
-		xp{x{1, 1, 3, 3, 0, 0}, x{0, 0, 2, 2, 0, 0}, 3}, //right overlap
-		xp{x{0, 0, 3, 3, 0, 0}, x{1, 1, 2, 2, 0, 0}, 3}, //left outer
-		xp{x{1, 1, 2, 2, 0, 0}, x{0, 0, 3, 3, 0, 0}, 3}, //right outer
-	}
+func TestWriteCoverprofile(t *testing.T) {
+	dir := tempDir(t, nil)
 
-	for _, p := range pairs {
-		testMerge(t, &p)
+	list := []*cover.Profile{
+		{FileName: "b/b.go", Mode: "count", Blocks: lb(bk(5, 1, 6, 2, 1, 0), bk(1, 1, 2, 2, 1, 3))},
+		{FileName: "a/a.go", Mode: "count", Blocks: lb(bk(3, 1, 4, 2, 2, 1))},
+		{FileName: "gen/gen.go", Mode: "count", Blocks: lb(bk(1, 1, 2, 2, 1, 1))},
 	}
-}
-func lb(blks ...cover.ProfileBlock) []cover.ProfileBlock {
-	return blks
-}
+	want := "mode: count\na/a.go:3.1,4.2 2 1\nb/b.go:1.1,2.2 1 3\nb/b.go:5.1,6.2 1 0\n"
 
-func blk(start, end int) cover.ProfileBlock {
-	return cover.ProfileBlock{StartLine: start, EndLine: end}
-}
+	path := filepath.Join(dir, "merged.cov")
+	require.NoError(t, writeCoverprofile(path, "count", list, patternList{}, map[string]bool{"gen/gen.go": true}))
+	got, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
 
-func bk(sl, sc, el, ec, s, c int) cover.ProfileBlock {
-	return cover.ProfileBlock{sl, sc, el, ec, s, c}
+	list[0], list[1] = list[1], list[0]
+	require.NoError(t, writeCoverprofile(path, "count", list, patternList{}, map[string]bool{"gen/gen.go": true}))
+	again, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, got, again, "same coverage, same bytes")
+
+	leftovers, err := filepath.Glob(filepath.Join(dir, ".*"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+
+	assert.Error(t, writeCoverprofile(filepath.Join(dir, "missing", "merged.cov"), "count", list, patternList{}, nil))
 }
 
-func TestMergeProfiles(t *testing.T) {
-	assert := assert.New(t)
+func TestMergedProfilesRewrites(t *testing.T) {
+	// the package's own profile, made here, and one made in a container
+	dir := tempDir(t, map[string]string{
+		"src/a.go":                             zeroSrc,
+		"src/b.go":                             zeroSrc,
+		"pkgs/example.com/sample.coverprofile": "mode: count\nexample.com/sample/a.go:4.2,4.11 1 1\n",
+		"ci.out":                               "mode: count\n/src/sample/a.go:4.2,4.11 1 2\n/src/sample/b.go:9.2,9.11 1 1\n",
+	})
+	src := filepath.Join(dir, "src")
+	sources := []pkgInfo{{ImportPath: "example.com/sample", Dir: src, GoFiles: []string{"a.go", "b.go"}}}
+	ci := filepath.Join(dir, "ci.out")
+	rewrites, err := parseRewrites("/src/sample=>example.com/sample")
+	require.NoError(t, err)
 
-	assert.Len(mergeBlocks(lb(blk(0, 0), blk(4, 4), blk(2, 2), blk(7, 8)), lb(blk(1, 1), blk(5, 5))), 6)
-	assert.Len(mergeBlocks(lb(blk(0, 7)), lb(blk(1, 5))), 3)
-	assert.Len(mergeBlocks(lb(blk(0, 7), blk(8, 9)), lb(blk(1, 5))), 4)
-	assert.Len(mergeBlocks(lb(bk(30, 41, 32, 2, 1, 0)), lb(bk(35, 52, 38, 2, 2, 0))), 2)
+	merged := filepath.Join(dir, "merged.out")
+	out := mergeOutput{dir: dir, path: merged, mixed: mixedConvert}
+	require.NoError(t, mergedProfiles(dir, out, "count", []string{"example.com/sample"}, []string{ci}, sources, patternList{}, false, "union", rewrites))
 
-	assert.Len(mergeBlocks(
-		lb(
-			bk(40, 60, 45, 24, 2, 0),
-			bk(45, 24, 46, 26, 1, 0),
-		),
-		lb(
-			bk(40, 60, 45, 24, 2, 0),
-			bk(45, 24, 46, 26, 1, 0),
-		),
-	),
-		2,
-	)
+	profs, err := cover.ParseProfiles(merged)
+	require.NoError(t, err)
+	require.Len(t, profs, 2)
+	assert.Equal(t, "example.com/sample/a.go", profs[0].FileName)
+	assert.Contains(t, profs[0].Blocks, bk(4, 2, 4, 11, 1, 3), "counts from both")
+	assert.Equal(t, "example.com/sample/b.go", profs[1].FileName)
+	assert.Contains(t, profs[1].Blocks, bk(9, 2, 9, 11, 1, 1))
 
-	assert.Len(mergeBlocks(
-		lb(
-			bk(30, 41, 32, 2, 1, 0),
-			bk(35, 52, 38, 2, 2, 0),
-			bk(40, 60, 45, 24, 2, 0),
-			bk(45, 24, 46, 26, 1, 0),
-			bk(46, 26, 48, 9, 2, 0),
-			bk(51, 2, 51, 24, 1, 0),
-			bk(51, 24, 52, 26, 1, 0),
-			bk(52, 26, 54, 9, 2, 0),
-			bk(57, 2, 57, 24, 1, 0),
-			bk(57, 24, 58, 23, 1, 0),
-			bk(58, 23, 60, 9, 2, 0),
-			bk(63, 2, 63, 24, 1, 0),
-			bk(63, 24, 64, 33, 1, 0),
-			bk(64, 33, 65, 39, 1, 0),
-			bk(65, 39, 67, 5, 1, 0),
-			bk(69, 3, 69, 27, 1, 0),
-			bk(69, 27, 70, 33, 1, 0),
-			bk(70, 33, 72, 5, 1, 0),
-			bk(75, 2, 75, 11, 1, 0),
-		),
-		lb(
-			bk(30, 41, 32, 2, 1, 0),
-			bk(35, 52, 38, 2, 2, 0),
-			bk(40, 60, 45, 24, 2, 0),
-			bk(45, 24, 46, 26, 1, 0),
-			bk(46, 26, 48, 9, 2, 0),
-			bk(51, 2, 51, 24, 1, 0),
-			bk(51, 24, 52, 26, 1, 0),
-			bk(52, 26, 54, 9, 2, 0),
-			bk(57, 2, 57, 24, 1, 0),
-			bk(57, 24, 58, 23, 1, 0),
-			bk(58, 23, 60, 9, 2, 0),
-			bk(63, 2, 63, 24, 1, 0),
-			bk(63, 24, 64, 33, 1, 0),
-			bk(64, 33, 65, 39, 1, 0),
-			bk(65, 39, 67, 5, 1, 0),
-			bk(69, 3, 69, 27, 1, 0),
-			bk(69, 27, 70, 33, 1, 0),
-			bk(70, 33, 72, 5, 1, 0),
-			bk(75, 2, 75, 11, 1, 0),
-		),
-	),
-		19,
-	)
+	err = mergedProfiles(dir, out, "count", nil, []string{filepath.Join(dir, "missing.out")}, sources, patternList{}, false, "union", rewrites)
+	assert.Error(t, err, "added profiles have to be there")
 }
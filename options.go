@@ -9,31 +9,57 @@ import (
 )
 
 type options struct {
-	verbose         bool
-	short           bool
-	parallel        bool
-	timeout         time.Duration
-	covermode       string
-	coverpkg        string
-	maxJobs         uint
-	coverdir        string
-	packageSelector string
-	exclude         string
-	excludeFiles    string
-	mergeBase       string
-	onlyMerge       bool
+	verbose          bool
+	short            bool
+	parallel         bool
+	timeout          time.Duration
+	covermode        string
+	coverpkg         string
+	coverStrategy    string
+	maxJobs          string
+	jobMemory        uint64
+	coverdir         string
+	packageSelector  string
+	exclude          string
+	excludeFiles     string
+	includeGenerated bool
+	mergeBase        string
+	onlyMerge        bool
+	mergePartial     bool
+	failFast         bool
+	timeBudget       time.Duration
+	retries          int
+	rerunFailed      bool
+	resume           bool
+	order            string
+	failedFirst      bool
+	history          string
+	console          string
+	lockWait         time.Duration
+	output           string
+	mixedModes       string
+	verify           bool
+	profile          []string
+	stale            string
+	mergeConflicts   string
+	rewrite          string
+	addProfiles      string
 }
 
 func defaultOpts() options {
-	return options{
-		coverdir: "/tmp",
-	}
+	return options{}
 }
 
 const (
 	version   = `0.1`
 	docstring = `Multiple-package coverage runner for Go
 Usage: engulf [options] <package-selector>
+       engulf verify [--rewrite=<rules>] <profile>...
+
+engulf verify checks cover profiles against the source they cover: that
+blocks are in order, don't overlap, lie within their files, and count the
+same statements as the source does. Problems are reported as
+<profile>:<line>: <source file>:<block>: <problem>.
 
 Options:
 	-v, --verbose                           Passed through to go test
@@ -41,13 +67,39 @@ Options:
 	-p, --parallel                          Passed through to go test
 	-t=<timeout>, --timeout=<timeout>       Passed through to go test [default: 10m]
 	--covermode=<mode>                      Passed directly to go test [default: count]
-	--coverpkg=<pkg>                        Passed directly to go test - defaults to <package-selector>
-	-j=<n>, --max-jobs=<n>                  Run at most <n> test processes at once [default: 3]
-	--coverdir=<dir>                        Storage dir for cover profiles [default: /tmp]
-	-x=<pattern>, --exclude=<pattern>       comma separated package <patterns> to exclude from coverage list [default: vendor/]
+	--coverpkg=<pkg>                        Passed directly to go test - overrides --cover-strategy
+	--cover-strategy=<strategy>             How to pick --coverpkg for each package: selector, self, module, deps-in-module or all [default: selector]
+	-j=<n>, --max-jobs=<n>                  Run at most <n> test processes at once, or "auto" to size from CPUs and memory [default: 3]
+	--job-memory=<size>                     Limit each test binary to <size> of address space (e.g. 2G), with ulimit -v; also sizes -j auto
+	--coverdir=<dir>                        Storage dir for cover profiles - defaults to a directory for the project under the system temp dir; "auto" makes a new one for the run
+	--lock-wait=<dur>                       If another engulf run is using the cover dir, wait up to <dur> for it, rather than failing [default: 0s]
+	-x=<pattern>, --exclude=<pattern>       comma separated package <patterns> to exclude from coverage list [default: **/vendor/**]
 	--exclude-files=<pattern>               comma separated file <patterns> to exclude from coverage list
-	--merge-base=<filename>                 base name to use for merging coverage
+	--include-generated                     Keep files marked "Code generated ... DO NOT EDIT." in merged coverage
+	-o=<file>, --output=<file>              Write the merged profile to <file>, or to stdout if it's -
+	--mixed-modes=<policy>                  If profiles were made in different cover modes: convert, to merge them as count (from count and atomic) or set (if any are set); error; or split, to write <file> as e.g. merged.count.out and merged.atomic.out [default: convert]
+	--merge-base=<filename>                 Without --output, merge into <mode><filename> in the cover dir, for each mode
 	--only-merge                            Don't do coverage, just merge coverage results
+	--fail-fast                             Stop at the first package that fails, cancelling the rest
+	--time-budget=<dur>                     Don't start any more packages once <dur> has passed
+	--retries=<n>                           Re-run a package's failing tests up to <n> times; flaky tests are listed in <coverdir>/flaky.json [default: 0]
+	--rerun-failed                          Only run the packages that didn't pass last time, reusing the other profiles in <coverdir>
+	--resume                                Skip packages an earlier, interrupted run already finished with the same flags and source
+	--order=<order>                         Order to start packages in: longest (expected, from earlier runs) or list (go list order) [default: longest]
+	--failed-first                          Start packages that failed last time before any others
+	--history=<file>                        Where to keep package durations between runs - defaults to <coverdir>/history.json
+	--console=<mode>                        stream: print results as packages finish; ordered: print them in go list order, with a status line per running package on a terminal [default: stream]
+	--stale=<policy>                        When merging, if a package's profile was made from source that has since changed: skip the package, or fail [default: skip]
+	--merge-conflicts=<policy>              If a file's blocks from different profiles don't line up: union, to keep the first blocks with the highest count for each line; drop, to leave the file out; or fail [default: union]
+	--rewrite=<rules>                       Comma separated <from>=><to> rules for file names in profiles made elsewhere, e.g. /src/app=>github.com/acme/app; the first rule whose <from> is a prefix of a name applies. Rules from $ENGULF_REWRITE, in the same form, apply after these
+	--add-profiles=<files>                  Comma separated profiles made elsewhere to merge in with the packages' own, with --rewrite applied
+	--merge-partial                         If stopped early, merge the profiles that completed, adding .partial to the file name
+
+Patterns are globs relative to the module root: * and ? match within a path
+segment, ** matches any number of segments, and a pattern matching a directory
+matches everything in it. A pattern starting with ! re-includes what an earlier
+pattern excluded. Patterns starting with regex: are regular expressions,
+matched anywhere in the full import path.
 `
 )
 
@@ -59,10 +111,20 @@ func parseOpts() options {
 		log.Fatal("parse:", err)
 	}
 
-	err = coerce.Struct(&opts, parsed, "-%s", "--%s", "<%s>")
+	err = coerce.Struct(&opts, parsed, "-%s", "--%s", "<%s>", "%s")
 	if err != nil {
 		log.Fatal("coerce: ", err)
 	}
 
+	// with no profiles, "engulf verify" reads as a run with verify for the
+	// package selector
+	if !opts.verify && opts.packageSelector == "verify" {
+		log.Fatal("engulf verify needs at least one profile (to test a package called verify, use ./verify)")
+	}
+	// nothing on stdout would say the profile was partial
+	if opts.mergePartial && opts.output == stdoutPath {
+		log.Fatal("--merge-partial can't be used with -o -: a partial profile on stdout would look complete")
+	}
+
 	return opts
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/cover"
+)
+
+// What to do with --output when profiles were recorded in different modes
+const (
+	mixedConvert = "convert" // merge them as a mode they have in common, with merge.Merger.Unify
+	mixedError   = "error"   // refuse to merge them
+	mixedSplit   = "split"   // write a file per mode, named by modePath
+)
+
+const stdoutPath = "-"
+
+// mergeOutput says where merged profiles are written: to path, with
+// --output, or else for each mode, to <mode><base> in dir.
+type mergeOutput struct {
+	dir, base string
+	path      string
+	mixed     string
+	stdout    io.Writer
+}
+
+// partial is where profiles merged from an incomplete run go.
+func (o mergeOutput) partial() mergeOutput {
+	if o.base != "" {
+		o.base += partialSuffix
+	}
+	if o.path != "" && o.path != stdoutPath {
+		o.path += partialSuffix
+	}
+	return o
+}
+
+// files picks a file for the profile in each of modes. Without --output, the
+// file for a mode is named for it, but more than one is still only written
+// with --mixed-modes=split.
+func (o mergeOutput) files(modes []string) (map[string]string, error) {
+	sort.Strings(modes)
+	files := make(map[string]string)
+	file := func(mode string) string {
+		if o.path == "" {
+			return filepath.Join(o.dir, mode+o.base)
+		}
+		return modePath(o.path, mode)
+	}
+	if len(modes) == 1 {
+		files[modes[0]] = o.path
+		if o.path == "" {
+			files[modes[0]] = file(modes[0])
+		}
+		return files, nil
+	}
+	switch {
+	case o.mixed == mixedSplit && o.path == stdoutPath:
+		return nil, fmt.Errorf("profiles have different modes (%s), and can't be split on stdout", strings.Join(modes, ", "))
+	case o.mixed == mixedSplit:
+		for _, mode := range modes {
+			files[mode] = file(mode)
+		}
+		return files, nil
+	case o.mixed == mixedError:
+		return nil, fmt.Errorf("profiles have different modes (%s): run them all with the same --covermode, or use --mixed-modes=%s or %s", strings.Join(modes, ", "), mixedConvert, mixedSplit)
+	default:
+		return nil, fmt.Errorf("unknown --mixed-modes %q", o.mixed)
+	}
+}
+
+// modePath names the file for mode's profile, when it's split out of path:
+// merged.out becomes merged.count.out.
+func modePath(path, mode string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + mode + ext
+}
+
+func (o mergeOutput) write(file, mode string, list []*cover.Profile, excludeFiles patternList, generated map[string]bool) error {
+	if file == stdoutPath {
+		return formatCoverprofile(o.stdout, mode, list, excludeFiles, generated)
+	}
+	return writeCoverprofile(file, mode, list, excludeFiles, generated)
+}
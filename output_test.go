@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/tools/cover"
+)
+
+func TestMergeOutputFiles(t *testing.T) {
+	legacy := mergeOutput{dir: "/c", base: "merged.txt", mixed: mixedSplit}
+	files, err := legacy.files([]string{"set", "count"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"count": "/c/countmerged.txt", "set": "/c/setmerged.txt"}, files)
+	files, err = legacy.partial().files([]string{"count"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"count": "/c/countmerged.txt.partial"}, files)
+	legacy.mixed = mixedError
+	_, err = legacy.files([]string{"set", "count"})
+	assert.Error(t, err, "the policy applies without --output too")
+
+	out := mergeOutput{dir: "/c", path: "cover.out", mixed: mixedError}
+	files, err = out.files([]string{"count"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"count": "cover.out"}, files)
+	_, err = out.files([]string{"count", "atomic"})
+	assert.Error(t, err)
+
+	out.mixed = mixedSplit
+	files, err = out.files([]string{"count", "atomic"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"count": "cover.count.out", "atomic": "cover.atomic.out"}, files)
+
+	out.path = stdoutPath
+	_, err = out.files([]string{"count", "atomic"})
+	assert.Error(t, err)
+	files, err = out.partial().files([]string{"count"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"count": stdoutPath}, files)
+}
+
+func TestMergeOutputStdout(t *testing.T) {
+	var buf bytes.Buffer
+	out := mergeOutput{path: stdoutPath, stdout: &buf}
+	list := []*cover.Profile{{FileName: "a/a.go", Mode: "set", Blocks: lb(bk(1, 1, 2, 2, 1, 1))}}
+	require.NoError(t, out.write(stdoutPath, "set", list, patternList{}, nil))
+	assert.Equal(t, "mode: set\na/a.go:1.1,2.2 1 1\n", buf.String())
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+type pkgInfo struct {
+	ImportPath   string
+	Dir          string
+	GoFiles      []string
+	CgoFiles     []string
+	TestGoFiles  []string
+	XTestGoFiles []string
+	Module       *struct {
+		Path, Dir string
+	}
+}
+
+func (p pkgInfo) hasTests() bool {
+	return len(p.TestGoFiles)+len(p.XTestGoFiles) > 0
+}
+
+// listPackages runs go list with args, which are usually just a package
+// selector.
+func listPackages(args ...string) ([]pkgInfo, error) {
+	gl := exec.Command("go", append([]string{"list", "-json"}, args...)...)
+	var stderr bytes.Buffer
+	gl.Stderr = &stderr
+	list, err := gl.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s%v", stderr.String(), err)
+	}
+
+	var pkgs []pkgInfo
+	dec := json.NewDecoder(bytes.NewReader(list))
+	for {
+		var p pkgInfo
+		err := dec.Decode(&p)
+		if err == io.EOF {
+			return pkgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pkgs = append(pkgs, p)
+	}
+}
+
+// moduleRoot is the import path patterns are relative to: the module path
+// when there is one.
+func moduleRoot(pkgs []pkgInfo) string {
+	for _, p := range pkgs {
+		if p.Module != nil {
+			return p.Module.Path
+		}
+	}
+	return ""
+}
+
+func importPaths(pkgs []pkgInfo) []string {
+	var paths []string
+	for _, p := range pkgs {
+		paths = append(paths, p.ImportPath)
+	}
+	return paths
+}
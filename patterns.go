@@ -0,0 +1,143 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+const regexPrefix = "regex:"
+
+type pattern struct {
+	source string
+	negate bool
+	raw    bool // a regex: pattern, matched anywhere in the full name
+	pkg    bool // a package pattern, matching the files in the packages it matches
+	re     *regexp.Regexp
+}
+
+// patternList is a list of exclusion patterns. As with .gitignore, the last
+// pattern to match a name decides whether it's excluded, so a !pattern can
+// re-include names that an earlier one excluded.
+type patternList struct {
+	root     string
+	patterns []pattern
+}
+
+// parsePatterns parses a comma separated list of patterns. Globs are matched
+// against names relative to root, where * and ? don't cross a /, and **
+// matches any number of path segments. A trailing /** matches the directory
+// itself as well as everything under it.
+func parsePatterns(list, root string) (patternList, error) {
+	pl := patternList{root: root}
+	for _, src := range strings.Split(list, ",") {
+		src = strings.TrimSpace(src)
+		if src == "" {
+			continue
+		}
+		p := pattern{source: src}
+		if strings.HasPrefix(src, "!") {
+			p.negate = true
+			src = src[1:]
+		}
+		var err error
+		if strings.HasPrefix(src, regexPrefix) {
+			p.raw = true
+			p.re, err = regexp.Compile(src[len(regexPrefix):])
+		} else {
+			p.re, err = regexp.Compile(globRegexp(src))
+		}
+		if err != nil {
+			return pl, err
+		}
+		pl.patterns = append(pl.patterns, p)
+	}
+	return pl, nil
+}
+
+func globRegexp(glob string) string {
+	glob = strings.Trim(glob, "/")
+	re := "^"
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case glob[i:] == "/**":
+			re += "(?:/.*)?"
+			i += 2
+		case strings.HasPrefix(glob[i:], "**/"):
+			re += "(?:.*/)?"
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			re += ".*"
+			i++
+		case glob[i] == '*':
+			re += "[^/]*"
+		case glob[i] == '?':
+			re += "[^/]"
+		default:
+			re += regexp.QuoteMeta(glob[i : i+1])
+		}
+	}
+	return re + "$"
+}
+
+// matches reports whether name is excluded. A glob that matches one of the
+// directories name is in also matches name.
+func (pl patternList) matches(name string) bool {
+	rel := name
+	if pl.root != "" && strings.HasPrefix(name, pl.root+"/") {
+		rel = name[len(pl.root)+1:]
+	}
+	excluded := false
+	for _, p := range pl.patterns {
+		if p.matches(name, rel) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+func (p pattern) matches(name, rel string) bool {
+	if p.pkg {
+		name, rel = path.Dir(name), path.Dir(rel)
+	}
+	if p.raw {
+		return p.re.MatchString(name)
+	}
+	for {
+		if p.re.MatchString(rel) {
+			return true
+		}
+		i := strings.LastIndex(rel, "/")
+		if i < 0 {
+			return false
+		}
+		rel = rel[:i]
+	}
+}
+
+func (pl patternList) String() string {
+	var srcs []string
+	for _, p := range pl.patterns {
+		srcs = append(srcs, p.source)
+	}
+	return strings.Join(srcs, ",")
+}
+
+// packageFiles returns a list that matches the files in the packages pl
+// matches.
+func (pl patternList) packageFiles() patternList {
+	files := patternList{root: pl.root}
+	for _, p := range pl.patterns {
+		p.pkg = true
+		files.patterns = append(files.patterns, p)
+	}
+	return files
+}
+
+// concat returns a list that applies pl's patterns, then other's.
+func (pl patternList) concat(other patternList) patternList {
+	return patternList{
+		root:     pl.root,
+		patterns: append(append([]pattern(nil), pl.patterns...), other.patterns...),
+	}
+}
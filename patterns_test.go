@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatterns(t *testing.T) {
+	pl, err := parsePatterns("**/vendor/**,!**/vendor/acme/**,mocks,**/*_gen.go,regex:legacy[0-9]", "example.com/app")
+	require.NoError(t, err)
+
+	for name, excluded := range map[string]bool{
+		"example.com/app/vendor/x":               true,
+		"example.com/app/sub/vendor/x/y.go":      true,
+		"example.com/app/vendor/acme/tool":       false,
+		"example.com/app/myvendor/x":             false,
+		"example.com/app/mocks":                  true,
+		"example.com/app/mocks/db.go":            true,
+		"example.com/app/sub/mocks/db.go":        false,
+		"example.com/app/sub/types_gen.go":       true,
+		"example.com/app/sub/types.go":           false,
+		"example.com/app/legacy2/old.go":         true,
+		"example.com/app":                        false,
+		"example.com/other/vendor/x/y.go":        true,
+		"example.com/other/mocks/unrelated.go":   false,
+		"example.com/app/sub/vendorized/thing":   false,
+		"example.com/app/sub/vendor/acme/x.go":   false,
+		"example.com/app/sub/vendor/acmeish/x":   true,
+		"example.com/app/sub/legacy/untouched":   false,
+		"example.com/app/sub/legacy9/touched.go": true,
+	} {
+		assert.Equal(t, excluded, pl.matches(name), name)
+	}
+}
+
+func TestEmptyPatterns(t *testing.T) {
+	pl, err := parsePatterns("", "example.com/app")
+	require.NoError(t, err)
+	assert.False(t, pl.matches("example.com/app/x.go"))
+	assert.Equal(t, "", pl.String())
+}
+
+func TestPackagePatterns(t *testing.T) {
+	pl, err := parsePatterns("gen/**,mocks/*", "example.com/app")
+	require.NoError(t, err)
+
+	assert.True(t, pl.matches("example.com/app/gen"), "the directory itself")
+	assert.True(t, pl.matches("example.com/app/gen/pb"))
+	assert.False(t, pl.matches("example.com/app/generate"))
+
+	files := pl.packageFiles()
+	assert.True(t, files.matches("example.com/app/gen/gen.go"))
+	assert.True(t, files.matches("example.com/app/gen/pb/pb.go"))
+	assert.True(t, files.matches("example.com/app/mocks/db/db.go"))
+	assert.False(t, files.matches("example.com/app/mocks/mocks.go"), "mocks itself isn't one of the packages under it")
+	assert.False(t, files.matches("example.com/app/generate/gen.go"))
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup puts c in a process group of its own, so that terminate
+// reaches the test binaries go test starts as well.
+func setProcessGroup(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminate asks c's process group to stop.
+func terminate(c *exec.Cmd) {
+	syscall.Kill(-c.Process.Pid, syscall.SIGTERM)
+}
+
+// kill stops c's process group outright, for tests that ignore terminate.
+func kill(c *exec.Cmd) {
+	syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
+
+// memoryLimitArgs are go test flags that run the test binary under an
+// address space limit of limit bytes, by way of a script in dir given to
+// -exec. Only the test binary is limited, not the compiler and linker go test
+// also runs. ulimit -v limits address space rather than resident memory, and
+// Go reserves address space ahead of using it, so the limit wants headroom
+// over what the tests really use.
+func memoryLimitArgs(dir string, limit uint64) ([]string, error) {
+	if limit == 0 {
+		return nil, nil
+	}
+	kb := strconv.FormatUint(limit/1024, 10)
+	script := filepath.Join(dir, "memlimit-"+kb+"k.sh")
+	content := "#!/bin/sh\nulimit -v " + kb + ` && exec "$@"` + "\n"
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		return nil, err
+	}
+	return []string{"-exec", script}, nil
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStopProcessKillsStubbornTests(t *testing.T) {
+	c := exec.Command("/bin/sh", "-c", "trap '' TERM; sleep 30")
+	setProcessGroup(c)
+	require.NoError(t, c.Start())
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+
+	// let the trap be set before it's needed
+	time.Sleep(100 * time.Millisecond)
+	began := time.Now()
+	stopProcess(c, done, 100*time.Millisecond)
+	assert.True(t, time.Since(began) < 5*time.Second, "killed after the grace period")
+}
+
+func TestMemoryLimitArgs(t *testing.T) {
+	dir := tempDir(t, nil)
+
+	args, err := memoryLimitArgs(dir, 0)
+	require.NoError(t, err)
+	assert.Empty(t, args)
+
+	args, err = memoryLimitArgs(dir, 2<<30)
+	require.NoError(t, err)
+	require.Len(t, args, 2)
+	assert.Equal(t, "-exec", args[0])
+	// go test runs the script with the test binary and its arguments
+	out, err := exec.Command(args[1], "/bin/sh", "-c", "ulimit -v").Output()
+	require.NoError(t, err)
+	assert.Equal(t, "2097152\n", string(out))
+}
+
+func TestBudgetAfterLastDispatch(t *testing.T) {
+	con, err := newConsole(outputStream, nil)
+	require.NoError(t, err)
+	defer con.close()
+	stop := make(chan result, 1)
+	dispatch, cancel := newStopper(), newStopper()
+
+	j := exec.Command("/bin/sh", "-c", "sleep 0.2", "sh", "example.com/last")
+	go func() { stop <- runJob(j, dispatch.c, cancel.c, 0, 0, con) }()
+	time.Sleep(50 * time.Millisecond)
+	// the budget runs out while the last package is running
+	dispatch.stop("time budget of 50ms used up")
+
+	res := <-stop
+	require.NoError(t, res.e)
+	assert.False(t, stoppedEarly(dispatch, 1, 1), "every package finished")
+	assert.True(t, stoppedEarly(dispatch, 2, 1), "one never started")
+	assert.False(t, stoppedEarly(newStopper(), 2, 1), "not stopped")
+}
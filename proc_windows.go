@@ -0,0 +1,18 @@
+package main
+
+import "os/exec"
+
+func setProcessGroup(c *exec.Cmd) {}
+
+func terminate(c *exec.Cmd) {
+	c.Process.Kill()
+}
+
+func kill(c *exec.Cmd) {
+	c.Process.Kill()
+}
+
+// memoryLimitArgs can't limit memory on windows
+func memoryLimitArgs(dir string, limit uint64) ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// assumed memory use of a go test process, when sizing jobs automatically
+	defaultJobMemory = 1 << 30
+	// Go test binaries reserve several hundred megabytes of address space
+	// before running anything, so --job-memory below this likely fails them all
+	minJobMemory = 1 << 30
+)
+
+var outOfMemoryRE = regexp.MustCompile(`(?i)runtime: out of memory|cannot allocate memory|fatal error: out of memory|fatal error: failed to reserve`)
+
+// parseJobs reads --max-jobs, which is either a number or "auto"
+func parseJobs(jobs string, jobMemory uint64) (uint, error) {
+	if jobs != "auto" {
+		n, err := strconv.ParseUint(jobs, 10, 32)
+		if err != nil || n == 0 {
+			return 0, fmt.Errorf("--max-jobs should be a positive number or auto, not %q", jobs)
+		}
+		return uint(n), nil
+	}
+	if jobMemory == 0 {
+		jobMemory = defaultJobMemory
+	}
+	cpus := availableCPUs()
+	n := uint(cpus)
+	mem, ok := availableMemory()
+	if ok {
+		if byMem := uint(mem / jobMemory); byMem < n {
+			n = byMem
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	if ok {
+		fmt.Printf("Running %d jobs at once: %d CPUs, %dMiB memory available\n", n, cpus, mem>>20)
+	} else {
+		fmt.Printf("Running %d jobs at once: %d CPUs\n", n, cpus)
+	}
+	return n, nil
+}
+
+// availableCPUs is the number of CPUs, or less if a cgroup quota says so.
+func availableCPUs() int {
+	cpus := runtime.NumCPU()
+	quota, period := -1.0, -1.0
+	if f := readFields("/sys/fs/cgroup/cpu.max"); len(f) == 2 {
+		quota, _ = strconv.ParseFloat(f[0], 64) // "max" is no quota
+		period, _ = strconv.ParseFloat(f[1], 64)
+	} else if q := readFields("/sys/fs/cgroup/cpu/cpu.cfs_quota_us"); len(q) == 1 {
+		quota, _ = strconv.ParseFloat(q[0], 64)
+		if p := readFields("/sys/fs/cgroup/cpu/cpu.cfs_period_us"); len(p) == 1 {
+			period, _ = strconv.ParseFloat(p[0], 64)
+		}
+	}
+	if quota > 0 && period > 0 {
+		if byQuota := int(quota / period); byQuota < cpus {
+			cpus = byQuota
+		}
+	}
+	if cpus < 1 {
+		cpus = 1
+	}
+	return cpus
+}
+
+// availableMemory is the memory free for use: what the kernel reckons is
+// available, or what's left under the cgroup limit, whichever is less.
+func availableMemory() (uint64, bool) {
+	avail, ok := memInfoAvailable()
+
+	limit, lok := readUint("/sys/fs/cgroup/memory.max")
+	usage, uok := readUint("/sys/fs/cgroup/memory.current")
+	if !lok {
+		limit, lok = readUint("/sys/fs/cgroup/memory/memory.limit_in_bytes")
+		usage, uok = readUint("/sys/fs/cgroup/memory/memory.usage_in_bytes")
+	}
+	if lok && uok && usage < limit && (!ok || limit-usage < avail) {
+		return limit - usage, true
+	}
+	return avail, ok
+}
+
+func memInfoAvailable() (uint64, bool) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			return kb * 1024, err == nil
+		}
+	}
+	return 0, false
+}
+
+func readFields(path string) []string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(content))
+}
+
+func readUint(path string) (uint64, bool) {
+	f := readFields(path)
+	if len(f) != 1 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(f[0], 10, 64)
+	return n, err == nil
+}
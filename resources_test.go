@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJobs(t *testing.T) {
+	n, err := parseJobs("4", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(4), n)
+
+	for _, bad := range []string{"0", "-1", "lots"} {
+		_, err := parseJobs(bad, 0)
+		assert.Error(t, err, bad)
+	}
+
+	n, err = parseJobs("auto", 1<<20)
+	assert.NoError(t, err)
+	assert.True(t, n >= 1 && int(n) <= availableCPUs())
+}
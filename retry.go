@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/nyarly/engulf/merge"
+	"golang.org/x/tools/cover"
+)
+
+// testEvent is the part of a go test -json event engulf cares about.
+type testEvent struct {
+	Action string
+	Test   string
+	Output string
+}
+
+// flakyTests records the tests in a package that failed, then passed on retry.
+type flakyTests struct {
+	Package  string   `json:"package"`
+	Tests    []string `json:"tests"`
+	Attempts int      `json:"attempts"`
+}
+
+// parseTestJSON turns go test -json output back into plain text, and finds
+// the top level tests that failed. Lines that aren't events (build failures,
+// say) are kept as they are. The run is aborted if tests started but the test
+// binary didn't get to the end: a panic, an os.Exit or a timeout stops it
+// without running the tests that come after, so more may have failed than
+// are listed.
+func parseTestJSON(out []byte) (text []byte, failed []string, aborted bool) {
+	var buf bytes.Buffer
+	seen := make(map[string]bool)
+	running := make(map[string]bool) // tests started and not yet done
+	started, ended := false, false
+	// a bufio.Reader, not a Scanner, so there's no limit on how long a line
+	// of output (a panic's stack dump, say) can be
+	r := bufio.NewReader(bytes.NewReader(out))
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			break
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		var ev testEvent
+		if len(line) == 0 || line[0] != '{' || json.Unmarshal(line, &ev) != nil {
+			buf.Write(line)
+			buf.WriteByte('\n')
+			continue
+		}
+		buf.WriteString(ev.Output)
+		switch {
+		case ev.Test == "":
+			// the test binary's last words, once it's run every test
+			if ev.Action == "output" && (ev.Output == "PASS\n" || ev.Output == "FAIL\n") {
+				ended = true
+			}
+		case ev.Action == "run":
+			started = true
+			running[ev.Test] = true
+		case ev.Action == "pass" || ev.Action == "fail" || ev.Action == "skip":
+			delete(running, ev.Test)
+		}
+		if ev.Action == "fail" && ev.Test != "" {
+			name := strings.SplitN(ev.Test, "/", 2)[0]
+			if !seen[name] {
+				seen[name] = true
+				failed = append(failed, name)
+			}
+		}
+	}
+	return buf.Bytes(), failed, started && (!ended || len(running) > 0)
+}
+
+// retryCommand runs just the named tests of j's package, or all of them if
+// none are named, writing a separate profile.
+func retryCommand(j *exec.Cmd, profile string, tests []string) *exec.Cmd {
+	var quoted []string
+	for _, t := range tests {
+		quoted = append(quoted, regexp.QuoteMeta(t))
+	}
+	last := len(j.Args) - 1
+	args := append([]string{}, j.Args[1:last]...)
+	for i, a := range args {
+		if strings.HasPrefix(a, "--coverprofile=") {
+			args[i] = "--coverprofile=" + profile
+		}
+	}
+	if len(tests) > 0 {
+		args = append(args, "-run", "^("+strings.Join(quoted, "|")+")$")
+	}
+	args = append(args, j.Args[last])
+	cmd := exec.Command(j.Args[0], args...)
+	cmd.Dir = j.Dir
+	return cmd
+}
+
+// retryFailed re-runs the failed tests from j up to retries times. If an
+// attempt passes, its coverage is merged into j's profile and the flaky tests
+// are returned; if none do, flaky is nil. When the test binary was aborted,
+// the tests after the one that stopped it never ran, so the whole package is
+// run again, and its profile replaces j's. What's run, and its output, is
+// written to transcript as it goes.
+func retryFailed(j *exec.Cmd, out []byte, retries int, cancel chan blank, transcript io.Writer) (text []byte, flaky *flakyTests, err error) {
+	profile := profileArg(j)
+	text, failed, aborted := parseTestJSON(out)
+	transcript.Write(text)
+	if len(failed) == 0 && !aborted || profile == "" {
+		return text, nil, nil
+	}
+	retryProfile := profile + ".retry"
+	defer os.Remove(retryProfile)
+
+	run := failed
+	if aborted {
+		run = nil
+	}
+	for attempt := 1; attempt <= retries; attempt++ {
+		cmd := retryCommand(j, retryProfile, run)
+		logCmd(transcript, cmd)
+		rout, err := combinedOutput(cmd, cancel)
+		rtext, _, _ := parseTestJSON(rout)
+		transcript.Write(rtext)
+		text = append(text, rtext...)
+		if err == errCancelled {
+			return text, nil, err
+		}
+		if err == nil {
+			if aborted {
+				err = os.Rename(retryProfile, profile)
+			} else {
+				err = combineProfiles(profile, profile, retryProfile)
+			}
+			if err != nil {
+				return text, nil, err
+			}
+			return text, &flakyTests{Package: j.Args[len(j.Args)-1], Tests: failed, Attempts: attempt + 1}, nil
+		}
+	}
+	return text, nil, nil
+}
+
+// combineProfiles merges the profiles in srcs into dst. They're all made
+// with the same flags, so they should all be in the same mode.
+func combineProfiles(dst string, srcs ...string) error {
+	m, err := merge.NewMerger(merge.Union)
+	if err != nil {
+		return err
+	}
+	for _, src := range srcs {
+		profs, err := cover.ParseProfiles(src)
+		if err != nil {
+			return err
+		}
+		if err := m.Add(src, profs); err != nil {
+			return err
+		}
+	}
+	modes := m.Modes()
+	switch len(modes) {
+	case 0:
+		return nil
+	case 1:
+		return writeCoverprofile(dst, modes[0], m.Profiles(modes[0]), patternList{}, nil)
+	default:
+		return fmt.Errorf("can't combine %s: profiles are in different modes (%s)", strings.Join(srcs, ", "), strings.Join(modes, ", "))
+	}
+}
+
+func writeFlaky(path string, flaky []*flakyTests) error {
+	return writeAtomically(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(flaky)
+	})
+}
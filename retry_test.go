@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/tools/cover"
+)
+
+func TestParseTestJSON(t *testing.T) {
+	out := []byte(`# example.com/app [build output]
+{"Action":"run","Test":"TestA"}
+{"Action":"output","Test":"TestA","Output":"=== RUN   TestA\n"}
+{"Action":"fail","Test":"TestA/sub"}
+{"Action":"fail","Test":"TestA"}
+{"Action":"pass","Test":"TestB"}
+{"Action":"fail","Test":"TestC"}
+{"Action":"output","Output":"FAIL\n"}
+{"Action":"fail"}
+`)
+	text, failed, aborted := parseTestJSON(out)
+	assert.Equal(t, "# example.com/app [build output]\n=== RUN   TestA\nFAIL\n", string(text))
+	assert.Equal(t, []string{"TestA", "TestC"}, failed)
+	assert.False(t, aborted)
+}
+
+func TestParseTestJSONAborted(t *testing.T) {
+	// TestA panicked, so TestB never ran
+	panicked := []byte(`{"Action":"run","Test":"TestA"}
+{"Action":"output","Test":"TestA","Output":"panic: boom\n"}
+{"Action":"fail","Test":"TestA"}
+{"Action":"output","Output":"FAIL\texample.com/app\t0.006s\n"}
+{"Action":"fail"}
+`)
+	_, failed, aborted := parseTestJSON(panicked)
+	assert.Equal(t, []string{"TestA"}, failed)
+	assert.True(t, aborted)
+
+	// TestA called os.Exit, and go test didn't say how it went
+	exited := []byte(`{"Action":"run","Test":"TestA"}
+{"Action":"output","Output":"FAIL\n"}
+{"Action":"fail"}
+`)
+	_, failed, aborted = parseTestJSON(exited)
+	assert.Empty(t, failed)
+	assert.True(t, aborted, "TestA never finished")
+
+	_, _, aborted = parseTestJSON([]byte("# example.com/app\n./a.go:1:1: syntax error\n"))
+	assert.False(t, aborted, "nothing started")
+}
+
+func TestParseTestJSONLongLines(t *testing.T) {
+	dump := strings.Repeat("x", 2<<20)
+	out := []byte(`{"Action":"output","Test":"TestA","Output":"` + dump + `\n"}
+{"Action":"fail","Test":"TestA"}
+{"Action":"fail","Test":"TestB"}`)
+	text, failed, _ := parseTestJSON(out)
+	assert.Equal(t, []string{"TestA", "TestB"}, failed)
+	assert.Equal(t, dump+"\n", string(text))
+}
+
+func TestCombineProfiles(t *testing.T) {
+	dir := tempDir(t, map[string]string{
+		"a":   "mode: count\nexample.com/a/a.go:1.1,2.1 1 0\n",
+		"b":   "mode: count\nexample.com/a/a.go:1.1,2.1 1 2\n",
+		"set": "mode: set\nexample.com/a/a.go:1.1,2.1 1 1\n",
+	})
+	a, b, set := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "set")
+	require.NoError(t, combineProfiles(a, a, b))
+	combined, err := ioutil.ReadFile(a)
+	require.NoError(t, err)
+	assert.Equal(t, "mode: count\nexample.com/a/a.go:1.1,2.1 1 2\n", string(combined))
+
+	assert.Error(t, combineProfiles(a, a, set), "mixed modes")
+}
+
+func TestRetryCommand(t *testing.T) {
+	j := exec.Command("go", "test", "--coverprofile=/tmp/a.coverprofile", "--coverpkg=./...", "--covermode=count", "-json", "example.com/app")
+	cmd := retryCommand(j, "/tmp/a.coverprofile.retry", []string{"TestA", "Test_B.x"})
+	assert.Equal(t, []string{
+		"go", "test", "--coverprofile=/tmp/a.coverprofile.retry", "--coverpkg=./...", "--covermode=count", "-json",
+		"-run", `^(TestA|Test_B\.x)$`, "example.com/app",
+	}, cmd.Args)
+
+	whole := retryCommand(j, "/tmp/a.coverprofile.retry", nil)
+	assert.Equal(t, []string{
+		"go", "test", "--coverprofile=/tmp/a.coverprofile.retry", "--coverpkg=./...", "--covermode=count", "-json", "example.com/app",
+	}, whole.Args)
+}
+
+func TestRetryAbortedPackage(t *testing.T) {
+	// TestA panics the first time it runs, taking TestB down with it
+	dir := tempDir(t, map[string]string{
+		"go.mod": "module example.com/app\n\ngo 1.16\n",
+		"a.go":   "package app\n\nfunc B() int {\n\treturn 1\n}\n",
+		"a_test.go": `package app
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestA(t *testing.T) {
+	if _, err := os.Stat("ran"); err != nil {
+		ioutil.WriteFile("ran", nil, 0644)
+		panic("boom")
+	}
+}
+
+func TestB(t *testing.T) {
+	B()
+}
+`,
+	})
+	profile := filepath.Join(dir, "app.coverprofile")
+	j := exec.Command("go", "test", "--coverprofile="+profile, "--coverpkg=./...", "--covermode=count", "-json", "example.com/app")
+	j.Dir = dir
+	first := exec.Command(j.Args[0], j.Args[1:]...)
+	first.Dir = dir
+	out, err := first.CombinedOutput()
+	require.Error(t, err)
+
+	var transcript bytes.Buffer
+	text, flaky, err := retryFailed(j, out, 1, make(chan blank), &transcript)
+	require.NoError(t, err)
+	require.NotNil(t, flaky, "%s", text)
+	assert.Equal(t, []string{"TestA"}, flaky.Tests)
+	assert.NotContains(t, transcript.String(), "-run", "the whole package is run again")
+
+	profs, err := cover.ParseProfiles(profile)
+	require.NoError(t, err)
+	require.Len(t, profs, 1)
+	assert.Equal(t, 1, profs[0].Blocks[0].Count, "TestB ran on retry")
+
+	summary := summarize(result{j: j, o: text, flaky: flaky})
+	assert.Regexp(t, `^ok  \texample.com/app\t.*\t\(flaky: passed on attempt 2\)\n$`, summary)
+}
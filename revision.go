@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// sourceRevision identifies the state of the source in dir: the git commit,
+// plus a hash of any uncommitted changes, including files git doesn't track
+// yet. It's empty outside of a git checkout.
+func sourceRevision(dir string) string {
+	git := func(args ...string) ([]byte, error) {
+		c := exec.Command("git", args...)
+		c.Dir = dir
+		return c.Output()
+	}
+	head, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return ""
+	}
+	rev := strings.TrimSpace(string(head))
+
+	status, err := git("status", "--porcelain", "-z", "--untracked-files=all")
+	if err != nil || len(status) == 0 {
+		return rev
+	}
+	diff, err := git("diff", "HEAD")
+	if err != nil {
+		return rev + "-dirty"
+	}
+	top, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return rev + "-dirty"
+	}
+	root := strings.TrimSpace(string(top))
+
+	h := sha1.New()
+	h.Write(diff)
+	// git diff leaves out untracked files, so they're hashed by name and
+	// content
+	entries := bytes.Split(status, []byte{0})
+	for i := 0; i < len(entries); i++ {
+		e := string(entries[i])
+		if strings.HasPrefix(e, "R") || strings.HasPrefix(e, "C") {
+			i++ // followed by the name it was renamed or copied from
+			continue
+		}
+		if !strings.HasPrefix(e, "?? ") {
+			continue
+		}
+		name := e[3:]
+		fmt.Fprintf(h, "untracked %s\n", name)
+		if content, err := ioutil.ReadFile(filepath.Join(root, name)); err == nil {
+			h.Write(content)
+		}
+	}
+	return fmt.Sprintf("%s-dirty-%x", rev, h.Sum(nil))
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceRevision(t *testing.T) {
+	dir := tempDir(t, nil)
+	assert.Equal(t, "", sourceRevision(dir), "not a checkout")
+
+	git := func(args ...string) {
+		c := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		c.Dir = dir
+		out, err := c.CombinedOutput()
+		require.NoError(t, err, "%s", out)
+	}
+	git("init", "-q")
+	writeFiles(t, dir, map[string]string{"a.go": "package a\n"})
+	git("add", "a.go")
+	git("commit", "-q", "-m", "a")
+
+	clean := sourceRevision(dir)
+	assert.Len(t, clean, 40)
+
+	writeFiles(t, dir, map[string]string{"b.go": "package a\n"})
+	untracked := sourceRevision(dir)
+	assert.NotEqual(t, clean, untracked, "new untracked file")
+
+	writeFiles(t, dir, map[string]string{"b.go": "package a\n\nvar B = 1\n"})
+	assert.NotEqual(t, untracked, sourceRevision(dir), "untracked file changed")
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "b.go")))
+	assert.Equal(t, clean, sourceRevision(dir))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/tools/cover"
+)
+
+const (
+	rewriteArrow = "=>"
+	// rewrite rules kept in the environment, for a CI setup say, in the same
+	// form as --rewrite
+	rewriteEnv = "ENGULF_REWRITE"
+)
+
+// rewriteRule replaces the prefix from of a profile's file names with to.
+type rewriteRule struct {
+	from, to string
+}
+
+// rewriteRules map file names in profiles made elsewhere (in a container, or
+// another checkout) onto this workspace. The first rule that matches a name
+// applies.
+type rewriteRules []rewriteRule
+
+// parseRewrites parses a comma separated list of from=>to rules.
+func parseRewrites(list string) (rewriteRules, error) {
+	var rules rewriteRules
+	for _, src := range strings.Split(list, ",") {
+		src = strings.TrimSpace(src)
+		if src == "" {
+			continue
+		}
+		parts := strings.SplitN(src, rewriteArrow, 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("rewrite rule %q isn't <from>%s<to>", src, rewriteArrow)
+		}
+		rules = append(rules, rewriteRule{
+			from: strings.TrimSuffix(strings.TrimSpace(parts[0]), "/"),
+			to:   strings.TrimSuffix(strings.TrimSpace(parts[1]), "/"),
+		})
+	}
+	return rules, nil
+}
+
+// loadRewrites parses the rules given on the command line, followed by any in
+// $ENGULF_REWRITE, so the command line takes precedence.
+func loadRewrites(flag string) (rewriteRules, error) {
+	rules, err := parseRewrites(flag)
+	if err != nil {
+		return nil, err
+	}
+	env, err := parseRewrites(os.Getenv(rewriteEnv))
+	if err != nil {
+		return nil, fmt.Errorf("$%s: %v", rewriteEnv, err)
+	}
+	return append(rules, env...), nil
+}
+
+// apply rewrites name by the first rule whose from is name, or one of the
+// directories it's in.
+func (rs rewriteRules) apply(name string) string {
+	for _, r := range rs {
+		if name == r.from {
+			return r.to
+		}
+		if strings.HasPrefix(name, r.from+"/") {
+			rest := name[len(r.from)+1:]
+			if r.to == "" {
+				return rest
+			}
+			return r.to + "/" + rest
+		}
+	}
+	return name
+}
+
+// profiles rewrites the file names of profs in place.
+func (rs rewriteRules) profiles(profs []*cover.Profile) {
+	for _, p := range profs {
+		p.FileName = rs.apply(p.FileName)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/tools/cover"
+)
+
+func TestRewriteRules(t *testing.T) {
+	rules, err := parseRewrites("/src/app/=>github.com/acme/app, /src=>/home/me/src,vendor/=>")
+	require.NoError(t, err)
+
+	for name, want := range map[string]string{
+		"/src/app/a.go":            "github.com/acme/app/a.go",
+		"/src/app":                 "github.com/acme/app",
+		"/src/application/a.go":    "/home/me/src/application/a.go",
+		"vendor/x.org/y/y.go":      "x.org/y/y.go",
+		"github.com/acme/app/b.go": "github.com/acme/app/b.go",
+	} {
+		assert.Equal(t, want, rules.apply(name), name)
+	}
+
+	profs := []*cover.Profile{{FileName: "/src/app/a.go"}}
+	rules.profiles(profs)
+	assert.Equal(t, "github.com/acme/app/a.go", profs[0].FileName)
+
+	_, err = parseRewrites("/src/app")
+	assert.Error(t, err)
+	_, err = parseRewrites("=>github.com/acme/app")
+	assert.Error(t, err)
+}
+
+func TestLoadRewrites(t *testing.T) {
+	defer os.Unsetenv(rewriteEnv)
+	os.Setenv(rewriteEnv, "/src/app=>example.com/env, /build=>example.com/build")
+
+	rules, err := loadRewrites("/src/app=>example.com/flag")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com/flag/a.go", rules.apply("/src/app/a.go"), "the command line comes first")
+	assert.Equal(t, "example.com/build/b.go", rules.apply("/build/b.go"))
+
+	os.Setenv(rewriteEnv, "nonsense")
+	_, err = loadRewrites("")
+	assert.Error(t, err)
+}
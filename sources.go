@@ -0,0 +1,55 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"path"
+	"path/filepath"
+	"regexp"
+)
+
+var generatedRE = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// sourceDirs maps import paths to the directories holding their source.
+type sourceDirs map[string]string
+
+func newSourceDirs(pkgs []pkgInfo) sourceDirs {
+	dirs := make(sourceDirs)
+	for _, p := range pkgs {
+		dirs[p.ImportPath] = p.Dir
+	}
+	return dirs
+}
+
+// path finds the file on disk for a profile's FileName.
+func (d sourceDirs) path(fileName string) (string, bool) {
+	if filepath.IsAbs(fileName) {
+		return fileName, true
+	}
+	dir, ok := d[path.Dir(fileName)]
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(dir, path.Base(fileName)), true
+}
+
+// isGenerated reports whether the file at path carries the standard
+// "Code generated ... DO NOT EDIT." comment ahead of its package clause.
+func isGenerated(path string) bool {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return false
+	}
+	for _, group := range file.Comments {
+		if group.Pos() > file.Package {
+			break
+		}
+		for _, c := range group.List {
+			if generatedRE.MatchString(c.Text) {
+				return true
+			}
+		}
+	}
+	return false
+}
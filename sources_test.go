@@ -0,0 +1,32 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsGenerated(t *testing.T) {
+	dir := tempDir(t, map[string]string{
+		"gen.go":   "// +build linux\n\n// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage sample\n",
+		"plain.go": "// Package sample is hand written.\npackage sample\n",
+		"late.go":  "package sample\n\n// Code generated by nothing. DO NOT EDIT.\n",
+	})
+
+	assert.True(t, isGenerated(filepath.Join(dir, "gen.go")))
+	assert.False(t, isGenerated(filepath.Join(dir, "plain.go")))
+	assert.False(t, isGenerated(filepath.Join(dir, "late.go")))
+	assert.False(t, isGenerated(filepath.Join(dir, "missing.go")))
+}
+
+func TestSourceDirsPath(t *testing.T) {
+	dirs := newSourceDirs([]pkgInfo{{ImportPath: "example.com/a/b", Dir: "/src/a/b"}})
+
+	p, ok := dirs.path("example.com/a/b/c.go")
+	assert.True(t, ok)
+	assert.Equal(t, "/src/a/b/c.go", p)
+
+	_, ok = dirs.path("example.com/a/c.go")
+	assert.False(t, ok)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/cover"
+)
+
+// What to do at merge time with a profile whose source has changed since it
+// was made
+const (
+	staleSkip = "skip" // leave it out of the merge
+	staleFail = "fail" // don't merge at all
+)
+
+// sourceHashes hashes source files, by the names profiles give them, once
+// each.
+type sourceHashes struct {
+	dirs   sourceDirs
+	hashes map[string]string
+}
+
+func newSourceHashes(dirs sourceDirs) *sourceHashes {
+	return &sourceHashes{dirs: dirs, hashes: make(map[string]string)}
+}
+
+// changedDuringRun stands in for the hash of a file that was changed after
+// the test binary covering it was built, so what it was built from isn't
+// known. It matches no file, so the profile counts as stale.
+const changedDuringRun = "changed during the run"
+
+// jobSources records the source a job's profile is made from: the hashes of
+// the package's own files, taken when the job was dispatched, before go test
+// built anything, and when that was.
+type jobSources struct {
+	hashes map[string]string
+	at     time.Time
+}
+
+// hash is the hash of fileName's content, or "" if it can't be read.
+func (h *sourceHashes) hash(fileName string) string {
+	if sum, ok := h.hashes[fileName]; ok {
+		return sum
+	}
+	sum := h.read(fileName)
+	h.hashes[fileName] = sum
+	return sum
+}
+
+// read hashes fileName as it is now, bypassing what's been hashed already.
+func (h *sourceHashes) read(fileName string) string {
+	if path, ok := h.dirs.path(fileName); ok {
+		if content, err := ioutil.ReadFile(path); err == nil {
+			return fmt.Sprintf("%x", sha256.Sum256(content))
+		}
+	}
+	return ""
+}
+
+// dispatched hashes pkg's source files as a job for it is dispatched. It
+// doesn't touch what's been hashed already, so jobs can be dispatched
+// concurrently.
+func (h *sourceHashes) dispatched(pkg pkgInfo) jobSources {
+	js := jobSources{hashes: make(map[string]string), at: time.Now()}
+	for _, name := range append(append([]string(nil), pkg.GoFiles...), pkg.CgoFiles...) {
+		fileName := pkg.ImportPath + "/" + name
+		if sum := h.read(fileName); sum != "" {
+			js.hashes[fileName] = sum
+		}
+	}
+	return js
+}
+
+// profileHashes hashes each of the files profile covers that can be found.
+// The hashes taken when the job was dispatched are used where there are any;
+// other files, from other packages the profile covers, are hashed now, unless
+// they've been changed since dispatch, when what was tested can't be known.
+func (h *sourceHashes) profileHashes(profile string, js jobSources) map[string]string {
+	profs, err := cover.ParseProfiles(profile)
+	if err != nil {
+		return nil
+	}
+	hashes := make(map[string]string)
+	for _, prof := range profs {
+		name := prof.FileName
+		if sum, ok := js.hashes[name]; ok {
+			hashes[name] = sum
+			continue
+		}
+		path, ok := h.dirs.path(name)
+		if !ok {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().After(js.at) {
+			hashes[name] = changedDuringRun
+		} else if sum := h.read(name); sum != "" {
+			hashes[name] = sum
+		}
+	}
+	return hashes
+}
+
+// changed lists the files r's profile covers that have changed since it was
+// made, and how.
+func (h *sourceHashes) changed(r *pkgRecord) []string {
+	var changes []string
+	for name, sum := range r.Files {
+		switch h.hash(name) {
+		case sum:
+		case "":
+			changes = append(changes, name+" is gone")
+		default:
+			changes = append(changes, name+" has changed")
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// freshPackages leaves out of pkgs those whose profiles were made from source
+// that has since changed, saying why. With staleFail, any such package is an
+// error instead. Packages the manifest doesn't know about are kept.
+func freshPackages(m *runManifest, pkgs []string, h *sourceHashes, policy string) ([]string, error) {
+	if policy != staleSkip && policy != staleFail {
+		return nil, fmt.Errorf("unknown --stale %q", policy)
+	}
+	var fresh, stale []string
+	for _, pkg := range pkgs {
+		r, ok := m.Packages[pkg]
+		if !ok {
+			fresh = append(fresh, pkg)
+			continue
+		}
+		changes := h.changed(r)
+		if len(changes) == 0 {
+			fresh = append(fresh, pkg)
+			continue
+		}
+		why := fmt.Sprintf("%s (profile made at revision %s): %s", pkg, r.Revision, strings.Join(changes, ", "))
+		if r.Revision == "" {
+			why = fmt.Sprintf("%s: %s", pkg, strings.Join(changes, ", "))
+		}
+		stale = append(stale, why)
+	}
+	if len(stale) == 0 {
+		return fresh, nil
+	}
+	if policy == staleFail {
+		return nil, fmt.Errorf("profiles are out of date with the source: \n\t%s\n", strings.Join(stale, "\n\t"))
+	}
+	fmt.Printf("Skipping profiles that are out of date with the source: \n\t%s\n", strings.Join(stale, "\n\t"))
+	return fresh, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreshPackages(t *testing.T) {
+	dir := tempDir(t, map[string]string{
+		"a.go":           "package a\n",
+		"b.go":           "package a\n",
+		"c.go":           "package a\n",
+		"a.coverprofile": "mode: count\nexample.com/a/a.go:1.1,1.2 1 0\nexample.com/a/b.go:1.1,1.2 1 0\nexample.com/a/c.go:1.1,1.2 1 0\nexample.com/elsewhere/x.go:1.1,1.2 1 0\n",
+	})
+	profile := filepath.Join(dir, "a.coverprofile")
+
+	dirs := sourceDirs{"example.com/a": dir}
+	files := newSourceHashes(dirs).profileHashes(profile, jobSources{at: time.Now()})
+	assert.Len(t, files, 3, "only what can be found")
+
+	m := newManifest()
+	m.record("example.com/a", &pkgRecord{Outcome: outcomePassed, Profile: profile, Revision: "abc", Files: files})
+	pkgs := []string{"example.com/a", "example.com/unknown"}
+
+	fresh, err := freshPackages(m, pkgs, newSourceHashes(dirs), staleFail)
+	require.NoError(t, err)
+	assert.Equal(t, pkgs, fresh)
+
+	writeFiles(t, dir, map[string]string{"b.go": "package a // changed\n"})
+	require.NoError(t, os.Remove(filepath.Join(dir, "c.go")))
+	fresh, err = freshPackages(m, pkgs, newSourceHashes(dirs), staleSkip)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com/unknown"}, fresh)
+
+	_, err = freshPackages(m, pkgs, newSourceHashes(dirs), staleFail)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "example.com/a (profile made at revision abc): example.com/a/b.go has changed, example.com/a/c.go is gone")
+}
+
+func TestProfileHashesFromDispatch(t *testing.T) {
+	dir := tempDir(t, map[string]string{
+		"a/a.go":         "package a\n",
+		"b/b.go":         "package b\n",
+		"c/c.go":         "package c\n",
+		"a.coverprofile": "mode: count\nexample.com/a/a.go:1.1,1.2 1 0\nexample.com/b/b.go:1.1,1.2 1 0\nexample.com/c/c.go:1.1,1.2 1 0\n",
+	})
+	dirs := sourceDirs{"example.com/a": filepath.Join(dir, "a"), "example.com/b": filepath.Join(dir, "b"), "example.com/c": filepath.Join(dir, "c")}
+	h := newSourceHashes(dirs)
+	before := map[string]string{"a": h.read("example.com/a/a.go"), "c": h.read("example.com/c/c.go")}
+
+	// c's file is older than the job
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "c", "c.go"), old, old))
+	js := h.dispatched(pkgInfo{ImportPath: "example.com/a", Dir: filepath.Join(dir, "a"), GoFiles: []string{"a.go"}})
+
+	// edits made while the tests run
+	later := time.Now().Add(time.Hour)
+	writeFiles(t, dir, map[string]string{"a/a.go": "package a // edited\n", "b/b.go": "package b // edited\n"})
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "b", "b.go"), later, later))
+
+	files := h.profileHashes(filepath.Join(dir, "a.coverprofile"), js)
+	assert.Equal(t, map[string]string{
+		"example.com/a/a.go": before["a"],
+		"example.com/b/b.go": changedDuringRun,
+		"example.com/c/c.go": before["c"],
+	}, files)
+}
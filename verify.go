@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/nyarly/engulf/merge"
+	"golang.org/x/tools/cover"
+)
+
+// the same format cover.ParseProfiles reads
+var profileLineRE = regexp.MustCompile(`^(.+):([0-9]+)\.([0-9]+),([0-9]+)\.([0-9]+) ([0-9]+) ([0-9]+)$`)
+
+// problem is something wrong with a profile, found by verify.
+type problem struct {
+	profile string
+	line    int    // in the profile
+	file    string // the source file, as named in the profile, or on disk
+	block   cover.ProfileBlock
+	msg     string
+}
+
+func (p problem) String() string {
+	if p.line == 0 {
+		return fmt.Sprintf("%s: %s", p.profile, p.msg)
+	}
+	if p.file == "" {
+		return fmt.Sprintf("%s:%d: %s", p.profile, p.line, p.msg)
+	}
+	return fmt.Sprintf("%s:%d: %s:%d.%d,%d.%d: %s", p.profile, p.line,
+		p.file, p.block.StartLine, p.block.StartCol, p.block.EndLine, p.block.EndCol, p.msg)
+}
+
+// profileLine is a block from a profile, and the line it's on.
+type profileLine struct {
+	line  int
+	block cover.ProfileBlock
+}
+
+// verify checks each of profiles against the source it covers, found by way
+// of rewrites, prints any problems it finds, and returns how many.
+func verify(profiles []string, rewrites rewriteRules) int {
+	count := 0
+	for _, profile := range profiles {
+		problems := verifyProfile(profile, rewrites)
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		count += len(problems)
+	}
+	if count > 0 {
+		fmt.Printf("%d problems found\n", count)
+	}
+	return count
+}
+
+func verifyProfile(profile string, rewrites rewriteRules) []problem {
+	mode, files, order, problems := readProfileLines(profile)
+	if len(files) == 0 {
+		return problems
+	}
+
+	var importPaths []string
+	seen := make(map[string]bool)
+	for _, name := range order {
+		if dir := path.Dir(rewrites.apply(name)); !seen[dir] {
+			seen[dir] = true
+			importPaths = append(importPaths, dir)
+		}
+	}
+	// -e, so that packages that have gone away are reported file by file
+	pkgs, err := listPackages(append([]string{"-e"}, importPaths...)...)
+	if err != nil {
+		return append(problems, problem{profile: profile, msg: fmt.Sprintf("can't find source: %v", err)})
+	}
+	dirs := newSourceDirs(pkgs)
+
+	for _, name := range order {
+		problems = append(problems, checkFile(profile, mode, name, dirs, rewrites, files[name])...)
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].line < problems[j].line })
+	return problems
+}
+
+// readProfileLines reads a profile line by line, keeping the blocks for each
+// file in the order they appear, which cover.ParseProfiles doesn't.
+func readProfileLines(profile string) (mode string, files map[string][]profileLine, order []string, problems []problem) {
+	files = make(map[string][]profileLine)
+	f, err := os.Open(profile)
+	if err != nil {
+		return "", nil, nil, []problem{{profile: profile, msg: err.Error()}}
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if line == 1 {
+			if _, err := fmt.Sscanf(text, "mode: %s", &mode); err != nil {
+				problems = append(problems, problem{profile: profile, line: line, msg: "first line isn't a mode line"})
+				continue
+			}
+			if mode != merge.ModeSet && mode != merge.ModeCount && mode != merge.ModeAtomic {
+				problems = append(problems, problem{profile: profile, line: line, msg: fmt.Sprintf("unknown mode %q", mode)})
+			}
+			continue
+		}
+		m := profileLineRE.FindStringSubmatch(text)
+		if m == nil {
+			problems = append(problems, problem{profile: profile, line: line, msg: fmt.Sprintf("can't read %q", text)})
+			continue
+		}
+		n := make([]int, 6)
+		for i := range n {
+			n[i], err = strconv.Atoi(m[i+2])
+		}
+		if err != nil {
+			problems = append(problems, problem{profile: profile, line: line, msg: err.Error()})
+			continue
+		}
+		name := m[1]
+		if _, ok := files[name]; !ok {
+			order = append(order, name)
+		}
+		files[name] = append(files[name], profileLine{line: line, block: cover.ProfileBlock{
+			StartLine: n[0], StartCol: n[1], EndLine: n[2], EndCol: n[3], NumStmt: n[4], Count: n[5],
+		}})
+	}
+	if err := scanner.Err(); err != nil {
+		problems = append(problems, problem{profile: profile, line: line, msg: err.Error()})
+	}
+	return mode, files, order, problems
+}
+
+// checkFile checks one file's blocks: that they're in order, don't overlap,
+// lie within the file, and count the same statements as the source does.
+func checkFile(profile, mode, name string, dirs sourceDirs, rewrites rewriteRules, lines []profileLine) []problem {
+	var problems []problem
+	report := func(pl profileLine, file, format string, args ...interface{}) {
+		problems = append(problems, problem{profile: profile, line: pl.line, file: file, block: pl.block, msg: fmt.Sprintf(format, args...)})
+	}
+
+	// the last new block, and the one that reaches furthest so far, which any
+	// block that overlaps an earlier one overlaps
+	var prev, furthest *profileLine
+	// profiles from several test binaries, as go test writes with -coverpkg,
+	// repeat each file's blocks, once for each binary
+	seen := make(map[[4]int]bool)
+	for i := range lines {
+		pl := &lines[i]
+		b := pl.block
+		if merge.Before(b.EndLine, b.EndCol, b.StartLine, b.StartCol) {
+			report(*pl, name, "block ends before it starts")
+		}
+		if mode == merge.ModeSet && b.Count > 1 {
+			report(*pl, name, "count of %d in set mode", b.Count)
+		}
+		if seen[blockKey(b)] {
+			continue
+		}
+		seen[blockKey(b)] = true
+		switch {
+		case prev == nil:
+		case merge.Before(b.StartLine, b.StartCol, prev.block.StartLine, prev.block.StartCol):
+			report(*pl, name, "out of order: starts before the block on line %d", prev.line)
+		case merge.Before(b.StartLine, b.StartCol, furthest.block.EndLine, furthest.block.EndCol):
+			report(*pl, name, "overlaps the block on line %d", furthest.line)
+		}
+		prev = pl
+		if furthest == nil || merge.Before(furthest.block.EndLine, furthest.block.EndCol, b.EndLine, b.EndCol) {
+			furthest = pl
+		}
+	}
+
+	src, ok := dirs.path(rewrites.apply(name))
+	if !ok {
+		report(lines[0], name, "can't find the source file")
+		return problems
+	}
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		report(lines[0], src, "%v", err)
+		return problems
+	}
+	lineLens := bytes.Split(content, []byte("\n"))
+	inBounds := func(line, col int) bool {
+		return line >= 1 && line <= len(lineLens) && col >= 1 && col <= len(lineLens[line-1])+1
+	}
+	for _, pl := range lines {
+		b := pl.block
+		if !inBounds(b.StartLine, b.StartCol) || !inBounds(b.EndLine, b.EndCol) {
+			report(pl, src, "outside the file, which has %d lines", len(lineLens))
+		}
+	}
+
+	blocks, err := sourceBlocks(src)
+	if err != nil {
+		report(lines[0], src, "can't parse: %v", err)
+		return problems
+	}
+	stmts := make(map[[4]int]int)
+	for _, b := range blocks {
+		stmts[blockKey(b)] = b.NumStmt
+	}
+	for _, pl := range lines {
+		if n, ok := stmts[blockKey(pl.block)]; ok && n != pl.block.NumStmt {
+			report(pl, src, "%d statements, but the source has %d", pl.block.NumStmt, n)
+		}
+	}
+	return problems
+}
+
+func blockKey(b cover.ProfileBlock) [4]int {
+	return [4]int{b.StartLine, b.StartCol, b.EndLine, b.EndCol}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/nyarly/engulf/merge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFile(t *testing.T) {
+	dir := tempDir(t, map[string]string{"s.go": zeroSrc})
+	dirs := sourceDirs{"example.com/sample": dir}
+	name := "example.com/sample/s.go"
+
+	good := []profileLine{{2, bk(4, 2, 4, 11, 1, 0)}, {3, bk(4, 2, 4, 11, 1, 2)}, {4, bk(5, 3, 6, 1, 1, 0)}}
+	assert.Empty(t, checkFile("p.out", merge.ModeCount, name, dirs, nil, good))
+
+	bad := []profileLine{
+		{2, bk(5, 3, 6, 1, 1, 0)},
+		{3, bk(4, 2, 4, 11, 1, 0)},    // out of order
+		{4, bk(5, 5, 6, 1, 1, 0)},     // overlaps
+		{5, bk(6, 9, 6, 18, 4, 0)},    // wrong statement count
+		{6, bk(9, 2, 8, 1, 1, 0)},     // backwards
+		{7, bk(900, 1, 901, 1, 1, 0)}, // past the end
+	}
+	problems := checkFile("p.out", merge.ModeCount, name, dirs, nil, bad)
+	var msgs []string
+	for _, p := range problems {
+		msgs = append(msgs, p.String())
+	}
+	assert.Len(t, problems, 5, "%v", msgs)
+	assert.Contains(t, msgs, "p.out:3: example.com/sample/s.go:4.2,4.11: out of order: starts before the block on line 2")
+	assert.Contains(t, msgs, "p.out:4: example.com/sample/s.go:5.5,6.1: overlaps the block on line 2")
+	assert.Contains(t, msgs, "p.out:5: "+filepath.Join(dir, "s.go")+":6.9,6.18: 4 statements, but the source has 1")
+	assert.Contains(t, msgs, "p.out:6: example.com/sample/s.go:9.2,8.1: block ends before it starts")
+
+	nested := []profileLine{
+		{2, bk(3, 1, 10, 1, 1, 0)},
+		{3, bk(4, 1, 5, 1, 1, 0)}, // overlaps
+		{4, bk(6, 1, 7, 1, 1, 0)}, // overlaps the block before last
+	}
+	problems = checkFile("p.out", merge.ModeCount, name, dirs, nil, nested)
+	msgs = nil
+	for _, p := range problems {
+		msgs = append(msgs, p.String())
+	}
+	assert.Equal(t, []string{
+		"p.out:3: example.com/sample/s.go:4.1,5.1: overlaps the block on line 2",
+		"p.out:4: example.com/sample/s.go:6.1,7.1: overlaps the block on line 2",
+	}, msgs)
+
+	rewrites := rewriteRules{{from: "/src/sample", to: "example.com/sample"}}
+	assert.Empty(t, checkFile("p.out", merge.ModeCount, "/src/sample/s.go", dirs, rewrites, good))
+
+	missing := checkFile("p.out", merge.ModeCount, "example.com/gone/g.go", dirs, nil, good)
+	require.Len(t, missing, 1)
+	assert.Contains(t, missing[0].msg, "can't find")
+}
+
+func TestCheckGoTestProfile(t *testing.T) {
+	// with -coverpkg, each package's test binary covers both packages, and go
+	// test writes out each file's blocks once per binary
+	dir := tempDir(t, map[string]string{
+		"go.mod":      "module example.com/app\n\ngo 1.16\n",
+		"a/a.go":      layoutSrc,
+		"a/a_test.go": "package sample\n\nimport \"testing\"\n\nfunc TestL(t *testing.T) {\n\tL([]int{1, -1, 200}, make(chan int))\n}\n",
+		"b/b.go":      "package b\n\nimport sample \"example.com/app/a\"\n\nfunc B() int {\n\tif sample.L(nil, nil) > 0 {\n\t\treturn 1\n\t}\n\treturn 0\n}\n",
+		"b/b_test.go": "package b\n\nimport \"testing\"\n\nfunc TestB(t *testing.T) {\n\tB()\n}\n",
+	})
+	profile := goCoverProfile(t, dir, "-coverpkg=./...", "./...")
+	dirs := sourceDirs{"example.com/app/a": filepath.Join(dir, "a"), "example.com/app/b": filepath.Join(dir, "b")}
+
+	mode, files, order, problems := readProfileLines(profile)
+	require.Empty(t, problems)
+	require.Equal(t, []string{"example.com/app/a/a.go", "example.com/app/b/b.go"}, order)
+	blocks, err := sourceBlocks(filepath.Join(dir, "a", "a.go"))
+	require.NoError(t, err)
+	require.Len(t, files[order[0]], 2*len(blocks), "repeated for each binary")
+
+	for _, name := range order {
+		assert.Empty(t, checkFile(profile, mode, name, dirs, nil, files[name]), name)
+	}
+
+	// the second binary's copy of a block with the wrong statement count
+	lines := files[order[0]]
+	wrong := &lines[len(blocks)+1]
+	wrong.block.NumStmt += 2
+	problems = checkFile(profile, mode, order[0], dirs, nil, lines)
+	require.Len(t, problems, 1)
+	assert.Equal(t, wrong.line, problems[0].line)
+	assert.Contains(t, problems[0].msg, "statements, but the source has")
+}
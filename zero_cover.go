@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/nyarly/engulf/merge"
+	"golang.org/x/tools/cover"
+)
+
+// zeroProfiles builds count-zero profiles for the source files of a package,
+// cgo files included, blocked out the way cmd/cover would instrument them.
+func zeroProfiles(pkg pkgInfo, mode string) ([]*cover.Profile, error) {
+	var profs []*cover.Profile
+	for _, name := range append(append([]string(nil), pkg.GoFiles...), pkg.CgoFiles...) {
+		blocks, err := sourceBlocks(filepath.Join(pkg.Dir, name))
+		if err != nil {
+			return nil, err
+		}
+		profs = append(profs, &cover.Profile{
+			FileName: pkg.ImportPath + "/" + name,
+			Mode:     mode,
+			Blocks:   blocks,
+		})
+	}
+	return profs, nil
+}
+
+// addZeroProfiles adds zero profiles for any of pkg's files that no test
+// binary loaded, in every mode present, other than those m dropped for
+// conflicting. It returns the names of files added.
+func addZeroProfiles(m *merge.Merger, modes []string, pkg pkgInfo) (added []string) {
+	seen := make(map[string]bool)
+	for _, mode := range modes {
+		profs, err := zeroProfiles(pkg, mode)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		var missing []*cover.Profile
+		for _, prof := range profs {
+			if !m.Has(mode, prof.FileName) && !m.Dropped(prof.FileName) {
+				missing = append(missing, prof)
+				if !seen[prof.FileName] {
+					seen[prof.FileName] = true
+					added = append(added, prof.FileName)
+				}
+			}
+		}
+		m.Add("", missing)
+	}
+	return
+}
+
+func sourceBlocks(path string) ([]cover.ProfileBlock, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, content, 0)
+	if err != nil {
+		return nil, err
+	}
+	bf := &blockFinder{fset: fset, content: content, seen: make(map[[4]int]bool)}
+	ast.Walk(bf, file)
+	return bf.blocks, nil
+}
+
+// blockFinder mirrors the block splitting done by cmd/cover, but records
+// the blocks rather than inserting counters. Like cmd/cover since Go 1.20,
+// blocks cover only lines with code on them: they start at the first token
+// after a brace, and are split where blank or comment lines come between
+// statements.
+type blockFinder struct {
+	fset    *token.FileSet
+	content []byte
+	blocks  []cover.ProfileBlock
+	seen    map[[4]int]bool
+}
+
+func (f *blockFinder) Visit(node ast.Node) ast.Visitor {
+	switch n := node.(type) {
+	case *ast.BlockStmt:
+		// switch and select bodies are lists of clauses: each clause is a block
+		if len(n.List) > 0 {
+			switch n.List[0].(type) {
+			case *ast.CaseClause:
+				for _, s := range n.List {
+					clause := s.(*ast.CaseClause)
+					f.addBlocks(clause.Colon+1, clause.Colon+1, clause.End(), clause.Body, false)
+				}
+				return f
+			case *ast.CommClause:
+				for _, s := range n.List {
+					clause := s.(*ast.CommClause)
+					f.addBlocks(clause.Colon+1, clause.Colon+1, clause.End(), clause.Body, false)
+				}
+				return f
+			}
+		}
+		f.addBlocks(n.Lbrace, n.Lbrace+1, n.Rbrace+1, n.List, true)
+	case *ast.IfStmt:
+		if n.Init != nil {
+			ast.Walk(f, n.Init)
+		}
+		ast.Walk(f, n.Cond)
+		ast.Walk(f, n.Body)
+		if n.Else == nil {
+			return nil
+		}
+		// cover wraps the else branch in a block that starts after "else"
+		elseOffset := f.findText(n.Body.End(), "else")
+		if elseOffset < 0 {
+			return nil
+		}
+		pos := f.fset.File(n.Body.End()).Pos(elseOffset + 4)
+		switch stmt := n.Else.(type) {
+		case *ast.IfStmt:
+			ast.Walk(f, &ast.BlockStmt{
+				Lbrace: pos,
+				List:   []ast.Stmt{stmt},
+				Rbrace: stmt.End(),
+			})
+		case *ast.BlockStmt:
+			ast.Walk(f, &ast.BlockStmt{
+				Lbrace: pos,
+				List:   stmt.List,
+				Rbrace: stmt.Rbrace,
+			})
+		}
+		return nil
+	case *ast.SelectStmt:
+		if n.Body == nil || len(n.Body.List) == 0 {
+			return nil
+		}
+	case *ast.SwitchStmt:
+		if n.Body == nil || len(n.Body.List) == 0 {
+			if n.Init != nil {
+				ast.Walk(f, n.Init)
+			}
+			if n.Tag != nil {
+				ast.Walk(f, n.Tag)
+			}
+			return nil
+		}
+	case *ast.TypeSwitchStmt:
+		if n.Body == nil || len(n.Body.List) == 0 {
+			if n.Init != nil {
+				ast.Walk(f, n.Init)
+			}
+			ast.Walk(f, n.Assign)
+			return nil
+		}
+	case *ast.FuncDecl:
+		// functions named _ can't be called; bodyless functions have no code
+		if n.Name.Name == "_" || n.Body == nil {
+			return nil
+		}
+	}
+	return f
+}
+
+func (f *blockFinder) addBlocks(pos, insertPos, blockEnd token.Pos, list []ast.Stmt, extendToClosingBrace bool) {
+	if len(list) == 0 {
+		r := f.codeRanges(insertPos, blockEnd)[0]
+		f.newBlock(r.pos, r.end, 0)
+		return
+	}
+	list = append([]ast.Stmt(nil), list...)
+	for {
+		var last int
+		end := blockEnd
+		for last = 0; last < len(list); last++ {
+			stmt := list[last]
+			end = statementBoundary(stmt)
+			if endsBasicSourceBlock(stmt) {
+				// a label may be a goto target, so it starts a new block
+				if label, isLabel := stmt.(*ast.LabeledStmt); isLabel && !isControl(label.Stmt) {
+					newLabel := *label
+					newLabel.Stmt = &ast.EmptyStmt{
+						Semicolon: label.Stmt.Pos(),
+						Implicit:  true,
+					}
+					end = label.Pos()
+					list[last] = &newLabel
+					list = append(list, nil)
+					copy(list[last+1:], list[last:])
+					list[last+1] = label.Stmt
+				}
+				last++
+				extendToClosingBrace = false
+				break
+			}
+		}
+		if extendToClosingBrace {
+			end = blockEnd
+		}
+		if pos != end {
+			for _, r := range mergeRangesWithinStatements(f.codeRanges(pos, end), list[:last]) {
+				f.newBlock(r.pos, r.end, last)
+			}
+		}
+		list = list[last:]
+		if len(list) == 0 {
+			break
+		}
+		pos = list[0].Pos()
+	}
+}
+
+// codeRange is a stretch of a block with code on every line.
+type codeRange struct {
+	pos, end token.Pos
+}
+
+// codeRanges splits start to end into the ranges with code in them, leaving
+// out braces, and blank and comment lines. With no code at all, it's a single
+// empty range at start.
+func (f *blockFinder) codeRanges(start, end token.Pos) []codeRange {
+	file := f.fset.File(start)
+	startOffset, endOffset := f.offset(start), f.offset(end)
+	src := f.content[startOffset:endOffset]
+	scanFile := token.NewFileSet().AddFile("", -1, len(src))
+	var s scanner.Scanner
+	s.Init(scanFile, src, nil, 0)
+	at := func(pos token.Pos) token.Pos {
+		return file.Pos(startOffset + scanFile.Offset(pos))
+	}
+
+	var ranges []codeRange
+	var codeStart token.Pos
+	prevEndLine := 0 // the last line with code on it, once there is one
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.LBRACE || tok == token.RBRACE || tok == token.SEMICOLON && lit == "\n" {
+			continue
+		}
+		startLine := scanFile.PositionFor(pos, false).Line
+		endLine := startLine
+		if tok == token.STRING {
+			// raw strings can span lines
+			endLine = scanFile.PositionFor(pos+token.Pos(len(lit)), false).Line
+		}
+		if prevEndLine == 0 {
+			codeStart = at(pos)
+		} else if startLine > prevEndLine+1 {
+			ranges = append(ranges, codeRange{codeStart, at(scanFile.LineStart(prevEndLine + 1))})
+			codeStart = at(pos)
+		}
+		if endLine > prevEndLine {
+			prevEndLine = endLine
+		}
+	}
+	if prevEndLine > 0 {
+		if prevEndLine < scanFile.LineCount() {
+			ranges = append(ranges, codeRange{codeStart, at(scanFile.LineStart(prevEndLine + 1))})
+		} else {
+			ranges = append(ranges, codeRange{codeStart, end})
+		}
+	}
+	if len(ranges) == 0 {
+		return []codeRange{{start, start}}
+	}
+	return ranges
+}
+
+// mergeRangesWithinStatements joins a range onto the one before it when it
+// starts inside a statement (a multi-line const block, say), rather than
+// splitting the statement.
+func mergeRangesWithinStatements(ranges []codeRange, stmts []ast.Stmt) []codeRange {
+	if len(ranges) <= 1 {
+		return ranges
+	}
+	merged := []codeRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		i := sort.Search(len(stmts), func(i int) bool { return stmts[i].Pos() >= r.pos })
+		if i > 0 && r.pos < stmts[i-1].End() {
+			merged[len(merged)-1].end = r.end
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+// newBlock records a block, by its position in the file as written, ignoring
+// //line directives. cmd/cover gives blocks with the same span distinct ends,
+// and so does newBlock.
+func (f *blockFinder) newBlock(start, end token.Pos, numStmt int) {
+	s := f.fset.PositionFor(start, false)
+	e := f.fset.PositionFor(end, false)
+	key := [4]int{s.Line, s.Column, e.Line, e.Column}
+	for f.seen[key] {
+		key[3]++
+	}
+	f.seen[key] = true
+	f.blocks = append(f.blocks, cover.ProfileBlock{
+		StartLine: key[0],
+		StartCol:  key[1],
+		EndLine:   key[2],
+		EndCol:    key[3],
+		NumStmt:   numStmt,
+	})
+}
+
+func (f *blockFinder) offset(pos token.Pos) int {
+	return f.fset.PositionFor(pos, false).Offset
+}
+
+// findText returns the offset of text at or after pos, skipping comments
+func (f *blockFinder) findText(pos token.Pos, text string) int {
+	b := []byte(text)
+	s := f.content
+	i := f.fset.Position(pos).Offset
+	for i < len(s) {
+		if bytes.HasPrefix(s[i:], b) {
+			return i
+		}
+		if i+2 <= len(s) && s[i] == '/' && s[i+1] == '/' {
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+			continue
+		}
+		if i+2 <= len(s) && s[i] == '/' && s[i+1] == '*' {
+			for i += 2; ; i++ {
+				if i+2 > len(s) {
+					return -1
+				}
+				if s[i] == '*' && s[i+1] == '/' {
+					i += 2
+					break
+				}
+			}
+			continue
+		}
+		i++
+	}
+	return -1
+}
+
+func statementBoundary(s ast.Stmt) token.Pos {
+	switch s := s.(type) {
+	case *ast.BlockStmt:
+		return s.Lbrace
+	case *ast.IfStmt:
+		if found, pos := hasFuncLiteral(s.Init); found {
+			return pos
+		}
+		if found, pos := hasFuncLiteral(s.Cond); found {
+			return pos
+		}
+		return s.Body.Lbrace
+	case *ast.ForStmt:
+		if found, pos := hasFuncLiteral(s.Init); found {
+			return pos
+		}
+		if found, pos := hasFuncLiteral(s.Cond); found {
+			return pos
+		}
+		if found, pos := hasFuncLiteral(s.Post); found {
+			return pos
+		}
+		return s.Body.Lbrace
+	case *ast.LabeledStmt:
+		return statementBoundary(s.Stmt)
+	case *ast.RangeStmt:
+		if found, pos := hasFuncLiteral(s.X); found {
+			return pos
+		}
+		return s.Body.Lbrace
+	case *ast.SwitchStmt:
+		if found, pos := hasFuncLiteral(s.Init); found {
+			return pos
+		}
+		if found, pos := hasFuncLiteral(s.Tag); found {
+			return pos
+		}
+		return s.Body.Lbrace
+	case *ast.SelectStmt:
+		return s.Body.Lbrace
+	case *ast.TypeSwitchStmt:
+		if found, pos := hasFuncLiteral(s.Init); found {
+			return pos
+		}
+		return s.Body.Lbrace
+	}
+	// a function literal's body is its own block
+	if found, pos := hasFuncLiteral(s); found {
+		return pos
+	}
+	return s.End()
+}
+
+func endsBasicSourceBlock(s ast.Stmt) bool {
+	switch s := s.(type) {
+	case *ast.BlockStmt, *ast.BranchStmt, *ast.ForStmt, *ast.IfStmt,
+		*ast.LabeledStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.SelectStmt,
+		*ast.TypeSwitchStmt:
+		return true
+	case *ast.ExprStmt:
+		if call, ok := s.X.(*ast.CallExpr); ok {
+			if ident, ok := call.Fun.(*ast.Ident); ok && ident.Name == "panic" && len(call.Args) == 1 {
+				return true
+			}
+		}
+	}
+	found, _ := hasFuncLiteral(s)
+	return found
+}
+
+func isControl(s ast.Stmt) bool {
+	switch s.(type) {
+	case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.SelectStmt, *ast.TypeSwitchStmt:
+		return true
+	}
+	return false
+}
+
+type funcLitFinder token.Pos
+
+func (f *funcLitFinder) Visit(node ast.Node) ast.Visitor {
+	if *f != 0 {
+		return nil
+	}
+	if n, ok := node.(*ast.FuncLit); ok {
+		*f = funcLitFinder(n.Body.Lbrace)
+		return nil
+	}
+	return f
+}
+
+func hasFuncLiteral(n ast.Node) (bool, token.Pos) {
+	if n == nil {
+		return false, 0
+	}
+	var literal funcLitFinder
+	ast.Walk(&literal, n)
+	return literal != 0, token.Pos(literal)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/nyarly/engulf/merge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/tools/cover"
+)
+
+const zeroSrc = `package sample
+
+func M(a int) (r int) {
+	if a > 3 {
+		r = 1
+	} else if a < 0 {
+		r = 2
+	}
+	switch a {
+	case 1:
+		r++
+	default:
+	}
+	return
+}
+
+func _() {}
+`
+
+func TestSourceBlocks(t *testing.T) {
+	path := filepath.Join(tempDir(t, map[string]string{"s.go": zeroSrc}), "s.go")
+
+	blocks, err := sourceBlocks(path)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []cover.ProfileBlock{
+		bk(4, 2, 4, 11, 1, 0),
+		bk(5, 3, 6, 1, 1, 0),
+		bk(6, 9, 6, 18, 1, 0),
+		bk(7, 3, 8, 1, 1, 0),
+		bk(9, 2, 9, 11, 1, 0),
+		bk(11, 3, 11, 6, 1, 0),
+		bk(12, 10, 12, 10, 0, 0),
+		bk(14, 2, 14, 8, 1, 0),
+	}, blocks)
+}
+
+const layoutSrc = `package sample
+
+import "fmt"
+
+func L(xs []int, c chan int) (n int) {
+	const (
+		a = 1
+
+		b = 2
+	)
+	n = a + b
+
+	// comment lines split blocks
+	n++
+	f := func() int {
+		return n
+	}
+	s := ` + "`" + `raw
+string` + "`" + `
+loop:
+	for _, x := range xs {
+		if x < 0 {
+			continue loop
+		}
+		if x > 100 {
+			goto done
+		}
+		n += x
+	}
+	select {
+	case v := <-c:
+		n += v
+	default:
+	}
+done:
+	fmt.Sprint(s, f())
+	return
+}
+
+func E() {}
+
+func P() {
+	panic("p")
+}
+`
+
+func TestSourceBlocksMatchGoTest(t *testing.T) {
+	dir := tempDir(t, map[string]string{
+		"go.mod":    "module example.com/sample\n\ngo 1.16\n",
+		"s.go":      zeroSrc,
+		"l.go":      layoutSrc,
+		"s_test.go": "package sample\n\nimport \"testing\"\n\nfunc TestNothing(t *testing.T) {}\n",
+	})
+	profs, err := cover.ParseProfiles(goCoverProfile(t, dir, "."))
+	require.NoError(t, err)
+	require.Len(t, profs, 2)
+
+	for _, prof := range profs {
+		blocks, err := sourceBlocks(filepath.Join(dir, filepath.Base(prof.FileName)))
+		require.NoError(t, err)
+		assert.ElementsMatch(t, prof.Blocks, blocks, prof.FileName)
+	}
+}
+
+func TestAddZeroProfiles(t *testing.T) {
+	dir := tempDir(t, map[string]string{"a.go": zeroSrc, "b.go": zeroSrc})
+	pkg := pkgInfo{ImportPath: "example.com/sample", Dir: dir, GoFiles: []string{"a.go", "b.go"}}
+
+	m, err := merge.NewMerger(merge.Union)
+	require.NoError(t, err)
+	covered := &cover.Profile{FileName: "example.com/sample/a.go", Mode: "count", Blocks: lb(bk(4, 2, 4, 11, 1, 1))}
+	require.NoError(t, m.Add("", []*cover.Profile{covered}))
+
+	added := addZeroProfiles(m, m.Modes(), pkg)
+	assert.Equal(t, []string{"example.com/sample/b.go"}, added)
+	profs := m.Profiles("count")
+	require.Len(t, profs, 2)
+	assert.Equal(t, covered.Blocks, profs[0].Blocks)
+	assert.Len(t, profs[1].Blocks, 8)
+}
+
+func TestAddZeroProfilesSkipsDropped(t *testing.T) {
+	dir := tempDir(t, map[string]string{"a.go": zeroSrc, "b.go": zeroSrc})
+	pkg := pkgInfo{ImportPath: "example.com/sample", Dir: dir, GoFiles: []string{"a.go", "b.go"}}
+
+	m, err := merge.NewMerger(merge.Drop)
+	require.NoError(t, err)
+	name := "example.com/sample/a.go"
+	require.NoError(t, m.Add("one", []*cover.Profile{{FileName: name, Mode: "count", Blocks: lb(bk(1, 1, 14, 1, 10, 1))}}))
+	require.NoError(t, m.Add("two", []*cover.Profile{{FileName: name, Mode: "count", Blocks: lb(bk(2, 1, 3, 1, 1, 5), bk(5, 1, 6, 1, 1, 0), bk(8, 1, 9, 1, 1, 0))}}))
+	require.True(t, m.Dropped(name))
+
+	added := addZeroProfiles(m, []string{"count"}, pkg)
+	assert.Equal(t, []string{"example.com/sample/b.go"}, added)
+	assert.False(t, m.Has("count", name))
+}
+
+func TestZeroProfilesCgo(t *testing.T) {
+	dir := tempDir(t, map[string]string{"a.go": zeroSrc, "c.go": "package sample\n\n// #include <stdlib.h>\nimport \"C\"\n\nfunc F() {\n\tC.abort()\n}\n"})
+	pkg := pkgInfo{ImportPath: "example.com/sample", Dir: dir, GoFiles: []string{"a.go"}, CgoFiles: []string{"c.go"}}
+
+	profs, err := zeroProfiles(pkg, "count")
+	require.NoError(t, err)
+	require.Len(t, profs, 2)
+	assert.Equal(t, "example.com/sample/c.go", profs[1].FileName)
+	assert.Equal(t, lb(bk(7, 2, 8, 1, 1, 0)), profs[1].Blocks)
+}